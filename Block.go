@@ -1,24 +1,42 @@
 package main
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// version of the block header created by this peer, blocks with any other version are rejected
+const block_version = 1
+
+// number of seconds a block's timestamp may be ahead of the local clock
+const max_block_time_drift = 2 * 60 * 60
+
+// number of blocks whose timestamps make up the median time past
+const median_time_span = 11
 
 // Type Block holds the information for a single block
 type Block struct {
+	Version        uint32
+	Height         uint64 // distance from the genisys node, which has height 1
+	Timestamp      int64  // unix time in seconds
 	Merkel_Root    Hash
 	Prev_Block     Hash
 	Nonce          Hash
 	Trailing_Zeros int
 }
 
-func create_block(merkel_root Hash, prev_block Hash, trailing_zeros int) Block {
-	return Block{Merkel_Root: merkel_root, Prev_Block: prev_block, Trailing_Zeros: trailing_zeros}
+func create_block(merkel_root Hash, prev_block Hash, height uint64, timestamp int64, trailing_zeros int) Block {
+	return Block{Version: block_version, Height: height, Timestamp: timestamp, Merkel_Root: merkel_root, Prev_Block: prev_block, Trailing_Zeros: trailing_zeros}
 }
 
 // Block's function mine randomly searches and sets a nonce that gives the given number of trailing
-// zeros when Merkel_Root, Prev_Block, and Nonce are hashed together
+// zeros when the block header is hashed
 func (block *Block) mine() {
 	for {
-		current_hash := concat_hash(block.Prev_Block, block.Merkel_Root, block.Nonce)
+		current_hash := block.hashed()
 		if current_hash.trailing_zeros() >= block.Trailing_Zeros {
 			break
 		}
@@ -26,23 +44,54 @@ func (block *Block) mine() {
 	}
 }
 
+// Block's method encode_header returns the canonical encoding of every field of the block header
+func (block Block) encode_header() []byte {
+	out := binary.BigEndian.AppendUint32(nil, block.Version)
+	out = binary.BigEndian.AppendUint64(out, block.Height)
+	out = binary.BigEndian.AppendUint64(out, uint64(block.Timestamp))
+	out = append(out, block.Prev_Block.Value[:]...)
+	out = append(out, block.Merkel_Root.Value[:]...)
+	out = binary.BigEndian.AppendUint32(out, uint32(block.Trailing_Zeros))
+	out = append(out, block.Nonce.Value[:]...)
+	return out
+}
+
 func (block Block) hashed() Hash {
-	return concat_hash(block.Prev_Block, block.Merkel_Root, block.Nonce)
+	return Hash{Value: sha256.Sum256(block.encode_header())}
 }
 
+// Block's method is_valid checks the rules that do not depend on the rest of the chain: the version, the proof of work,
+// the height of a genisys node and that the timestamp is not too far in the future
 func (block Block) is_valid() bool {
 	current_hash := block.hashed()
+	if block.Version != block_version || block.Height == 0 || (block.Prev_Block == (Hash{})) != (block.Height == 1) {
+		return false
+	}
+	if block.Timestamp > time.Now().Unix()+max_block_time_drift {
+		return false
+	}
 	return current_hash.trailing_zeros() >= block.Trailing_Zeros
 }
 
+// Block's method work returns the expected number of hashes needed to mine the block, 2 to the power of its trailing zeros
+func (block Block) work() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(max(block.Trailing_Zeros, 0)))
+}
+
 func (block Block) pretty_print() string {
-	return fmt.Sprintf("Merkel_Root: %v\nPrev_Block: %v\nNonce: %v\nTrailing_Zeros: %v\n",
+	return fmt.Sprintf("Version: %v\nHeight: %v\nTimestamp: %v\nMerkel_Root: %v\nPrev_Block: %v\nNonce: %v\nTrailing_Zeros: %v\n",
+		block.Version,
+		block.Height,
+		block.Timestamp,
 		block.Merkel_Root.to_string(),
 		block.Prev_Block.to_string(),
 		block.Nonce.to_string(),
 		block.Trailing_Zeros)
 }
 
+// Version        uint32
+// Height         uint64
+// Timestamp      int64
 // Merkel_Root    Hash
 // Prev_Block     Hash
 // Nonce          Hash
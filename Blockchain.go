@@ -1,59 +1,125 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
 
-// Type Blockchain holds an entire blockchain
+// errors returned for blocks that would reorganize blocks that are final
+var (
+	err_checkpoint_conflict = errors.New("block contradicts a checkpoint")
+	err_beyond_finality     = errors.New("block forks off below the finality depth")
+)
+
+// Type Blockchain holds an entire blockchain as a tree of blocks. the cumulative work and children of every block
+// and the tip of the best chain are kept up to date as blocks are added and removed
 type Blockchain struct {
-	Blocks       map[Hash]Block
-	Merkel_Trees map[Hash]MerkelTree
+	Blocks           map[Hash]Block
+	Merkel_Trees     map[Hash]MerkelTree
+	Params           ChainParams       // consensus rules the blocks are checked against
+	Chain_Work       map[Hash]*big.Int // {block hash: work of the block and its ancestors}
+	Children         map[Hash][]Hash   // {block hash: hashes of the blocks built on it}, the zero hash holds the genisys nodes
+	Branch_Points    map[Hash]bool     // hashes of the blocks more than one block is built on
+	Leaves           map[Hash]bool     // hashes of the blocks no block is built on, the tips of all the chains
+	Merkel_Tree_Refs map[Hash]int      // {merkel root: number of blocks using the merkel tree}
+	Tip              Hash              // last block of the chain with the most cumulative work
+	Chain_Id         Hash              // hash of the genisys node every block has to descend from
 }
 
-// Blockchain's private method __calc_block_length_values maps each blocks hash to its distance from the genisys node
-func (blockchain *Blockchain) __calc_block_length_values() *map[Hash]int {
-	dp := make(map[Hash]int)
-	for block_hash := range blockchain.Blocks {
-		dp[block_hash] = -2
-	}
-	var calc func(block *Block) int
-	calc = func(block *Block) int {
-		block_hash := block.hashed()
-		if dp[block_hash] == -2 {
-			if block.Prev_Block == (Hash{}) {
-				dp[block_hash] = 1
-			} else {
-				prev_block, ok := blockchain.Blocks[block.Prev_Block]
-				length := -1
-				if ok {
-					length = calc(&prev_block)
-				}
-				if length == -1 {
-					dp[block_hash] = -1
-				} else {
-					dp[block_hash] = length + 1
-				}
-			}
-		}
-		return dp[block_hash]
-	}
-	for block_hash, block := range blockchain.Blocks {
-		dp[block_hash] = calc(&block)
-	}
-	return &dp
+// function create_blockchain returns a blockchain following the given chain parameters that holds only the genisys
+// node they define
+func create_blockchain(params ChainParams) Blockchain {
+	blockchain := __empty_blockchain(params)
+	genesis, merkel_tree := genesis_block(params)
+	blockchain.Chain_Id = genesis.hashed()
+	blockchain.add_block(genesis)
+	blockchain.add_merkel_tree(merkel_tree)
+	return blockchain
 }
 
-// function create_blockchain returns an empty blockchain
-func create_blockchain() Blockchain {
-	return Blockchain{Blocks: make(map[Hash]Block), Merkel_Trees: make(map[Hash]MerkelTree)}
+func __empty_blockchain(params ChainParams) Blockchain {
+	return Blockchain{
+		Blocks:           make(map[Hash]Block),
+		Merkel_Trees:     make(map[Hash]MerkelTree),
+		Params:           params,
+		Chain_Work:       make(map[Hash]*big.Int),
+		Children:         make(map[Hash][]Hash),
+		Branch_Points:    make(map[Hash]bool),
+		Leaves:           make(map[Hash]bool),
+		Merkel_Tree_Refs: make(map[Hash]int),
+	}
 }
 
+// Blockchain's method add_block adds a block whose previous block is already in the blockchain (or a genisys node)
+// and moves the tip to it if its chain has more work than the best chain
 func (blockchain *Blockchain) add_block(block Block) {
 	block_hash := block.hashed()
+	if _, ok := blockchain.Blocks[block_hash]; ok {
+		return
+	}
 	blockchain.Blocks[block_hash] = block
+	blockchain.Children[block.Prev_Block] = append(blockchain.Children[block.Prev_Block], block_hash)
+	if len(blockchain.Children[block.Prev_Block]) > 1 {
+		blockchain.Branch_Points[block.Prev_Block] = true
+	}
+	delete(blockchain.Leaves, block.Prev_Block)
+	blockchain.Leaves[block_hash] = true
+	blockchain.Merkel_Tree_Refs[block.Merkel_Root]++
+	work := new(big.Int).Set(block.work())
+	if prev_work, ok := blockchain.Chain_Work[block.Prev_Block]; ok {
+		work.Add(work, prev_work)
+	}
+	blockchain.Chain_Work[block_hash] = work
+	if blockchain.__is_better_tip(block_hash) {
+		blockchain.Tip = block_hash
+	}
 }
 
+// Blockchain's method remove_block removes a block along with its merkel tree once no other block uses it. the
+// blocks built on it should be removed first. if the tip is removed the best remaining chain tip becomes the tip
 func (blockchain *Blockchain) remove_block(block Block) {
 	block_hash := block.hashed()
+	if _, ok := blockchain.Blocks[block_hash]; !ok {
+		return
+	}
 	delete(blockchain.Blocks, block_hash)
+	delete(blockchain.Chain_Work, block_hash)
+	delete(blockchain.Children, block_hash)
+	delete(blockchain.Branch_Points, block_hash)
+	delete(blockchain.Leaves, block_hash)
+	siblings := blockchain.Children[block.Prev_Block]
+	for i, sibling := range siblings {
+		if sibling == block_hash {
+			blockchain.Children[block.Prev_Block] = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(blockchain.Children[block.Prev_Block]) == 0 {
+		delete(blockchain.Children, block.Prev_Block)
+		if _, ok := blockchain.Blocks[block.Prev_Block]; ok {
+			blockchain.Leaves[block.Prev_Block] = true
+		}
+	}
+	if len(blockchain.Children[block.Prev_Block]) < 2 {
+		delete(blockchain.Branch_Points, block.Prev_Block)
+	}
+	if blockchain.Merkel_Tree_Refs[block.Merkel_Root]--; blockchain.Merkel_Tree_Refs[block.Merkel_Root] <= 0 {
+		delete(blockchain.Merkel_Tree_Refs, block.Merkel_Root)
+		delete(blockchain.Merkel_Trees, block.Merkel_Root)
+	}
+	if blockchain.Tip == block_hash {
+		// the best chain ends at a leaf, so only the leaves are compared
+		blockchain.Tip = Hash{}
+		for leaf_hash := range blockchain.Leaves {
+			if blockchain.__is_better_tip(leaf_hash) {
+				blockchain.Tip = leaf_hash
+			}
+		}
+	}
 }
 
 func (blockchain *Blockchain) add_merkel_tree(merkel_tree MerkelTree) {
@@ -61,43 +127,324 @@ func (blockchain *Blockchain) add_merkel_tree(merkel_tree MerkelTree) {
 	blockchain.Merkel_Trees[merkel_tree_hash] = merkel_tree
 }
 
-func (blockchain *Blockchain) remove_merkel_tree(merkel_tree MerkelTree) {
-	merkel_tree_hash := merkel_tree.hashed()
-	delete(blockchain.Merkel_Trees, merkel_tree_hash)
+// Blockchain's method remove_added_blocks removes the given blocks, which are the blocks added last in the order they
+// were added, and moves the tip back to tip, the tip from before they were added
+func (blockchain *Blockchain) remove_added_blocks(blocks []Block, tip Hash) {
+	blockchain.Tip = tip // so that removing the blocks does not look for a new tip
+	for i := len(blocks) - 1; i >= 0; i-- {
+		blockchain.remove_block(blocks[i])
+	}
 }
 
-// Blockchain's method get_last_hash returns the hash of the block that is farthest from the genisys node
+// Blockchain's method get_last_hash returns the hash of the tip of the chain with the most cumulative work
 func (blockchain Blockchain) get_last_hash() Hash {
-	if len(blockchain.Blocks) == 0 {
-		return Hash{}
+	return blockchain.Tip
+}
+
+// Blockchain's method chain_work returns the total work of the block with the given hash and its ancestors
+func (blockchain Blockchain) chain_work(block_hash Hash) *big.Int {
+	if work, ok := blockchain.Chain_Work[block_hash]; ok {
+		return new(big.Int).Set(work)
 	}
-	dp := blockchain.__calc_block_length_values()
-	max_length, best_block := -1, Block{}
-	for block_hash, block := range blockchain.Blocks {
-		length := (*dp)[block_hash]
-		if length > max_length {
-			max_length = length
-			best_block = block
+	return big.NewInt(0)
+}
+
+// Blockchain's private method __is_better_tip returns true if the chain ending at the given block has more work than
+// the current best chain. chains with equal work are ordered by the hash of their tip so that every peer picks the
+// same one, the lower hash wins
+func (blockchain Blockchain) __is_better_tip(block_hash Hash) bool {
+	tip_work, ok := blockchain.Chain_Work[blockchain.Tip]
+	if !ok {
+		return true
+	}
+	cmp := blockchain.Chain_Work[block_hash].Cmp(tip_work)
+	return cmp > 0 || (cmp == 0 && block_hash.less(blockchain.Tip))
+}
+
+// Blockchain's method find_fork returns the hash of the last block the chains ending at the two given blocks have
+// in common, the zero hash if they do not share a genisys node
+func (blockchain Blockchain) find_fork(first_hash Hash, second_hash Hash) Hash {
+	first, first_ok := blockchain.Blocks[first_hash]
+	second, second_ok := blockchain.Blocks[second_hash]
+	for first_ok && second_ok && first_hash != second_hash {
+		if first.Height >= second.Height {
+			first_hash = first.Prev_Block
+			first, first_ok = blockchain.Blocks[first_hash]
+		} else {
+			second_hash = second.Prev_Block
+			second, second_ok = blockchain.Blocks[second_hash]
+		}
+	}
+	if first_ok && second_ok {
+		return first_hash
+	}
+	return Hash{}
+}
+
+// Blockchain's method blocks_after returns the blocks after the given ancestor up to and including the given block in
+// order. an ancestor of zero hash returns the whole chain ending at the block
+func (blockchain Blockchain) blocks_after(ancestor_hash Hash, block_hash Hash) []Block {
+	blocks := make([]Block, 0)
+	block, ok := blockchain.Blocks[block_hash]
+	for ok && block_hash != ancestor_hash {
+		blocks = append(blocks, block)
+		block_hash = block.Prev_Block
+		block, ok = blockchain.Blocks[block_hash]
+	}
+	return reverse_slice(blocks)
+}
+
+// Blockchain's method best_chain returns the blocks from the genisys node to the block returned by get_last_hash in order
+func (blockchain Blockchain) best_chain() []Block {
+	return blockchain.blocks_after(Hash{}, blockchain.Tip)
+}
+
+// Blockchain's method locator returns a block locator of the chain ending at the given block: the hashes of the block
+// and its ancestors back to the genisys node, the last ten one apart and each one after twice as far as the one
+// before. headers that are not in the blockchain yet can be given in pending so that the chain may run through them
+func (blockchain Blockchain) locator(block_hash Hash, pending map[Hash]Block) []Hash {
+	lookup := func(hash Hash) (Block, bool) {
+		if block, ok := blockchain.Blocks[hash]; ok {
+			return block, true
+		}
+		block, ok := pending[hash]
+		return block, ok
+	}
+	locator, step := make([]Hash, 0), 1
+	block, ok := lookup(block_hash)
+	for ok && len(locator) < max_locator_size {
+		locator = append(locator, block_hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		for i := 0; ok && i < step && block.Prev_Block != (Hash{}); i++ {
+			block_hash = block.Prev_Block
+			block, ok = lookup(block_hash)
+		}
+		if block_hash == locator[len(locator)-1] {
+			break // reached the genisys node
+		}
+	}
+	return locator
+}
+
+// Blockchain's method headers_after returns up to limit blocks of the best chain that follow the first block of the
+// locator found on the best chain, up to and including the stop block. the blocks after the genisys node are returned
+// if no block of the locator is on the best chain
+func (blockchain Blockchain) headers_after(locator []Hash, stop Hash, limit int) []Block {
+	best_chain := blockchain.best_chain()
+	positions := make(map[Hash]int, len(best_chain))
+	for i, block := range best_chain {
+		positions[block.hashed()] = i
+	}
+	start := 0
+	for _, block_hash := range locator {
+		if i, ok := positions[block_hash]; ok {
+			start = i
+			break
+		}
+	}
+	headers := make([]Block, 0)
+	for _, block := range best_chain[start+1:] {
+		if len(headers) >= limit {
+			break
+		}
+		headers = append(headers, block)
+		if block.hashed() == stop {
+			break
+		}
+	}
+	return headers
+}
+
+// Blockchain's method blocks_from_locator returns up to limit blocks in order that lead from the last block of the
+// chain ending at the stop block that is in the locator to the stop block. unlike headers_after the stop block may be
+// on a side branch, a zero stop hash stands for the tip. nothing is returned for an unknown stop block. the blocks
+// after the genisys node are returned if no block of the locator is on the chain, since every peer has the genisys
+// node. if more blocks lead to the stop block, the first limit - 1 of them are returned followed by the stop block
+// itself, so that the receiver sees a block whose previous block it lacks and asks for the rest
+func (blockchain Blockchain) blocks_from_locator(locator []Hash, stop Hash, limit int) []Block {
+	if stop == (Hash{}) {
+		stop = blockchain.Tip
+	}
+	in_locator := map[Hash]bool{blockchain.Chain_Id: true}
+	for _, block_hash := range locator {
+		in_locator[block_hash] = true
+	}
+	blocks := make([]Block, 0)
+	block, ok := blockchain.Blocks[stop]
+	for ok && !in_locator[stop] {
+		blocks = append(blocks, block)
+		stop = block.Prev_Block
+		block, ok = blockchain.Blocks[stop]
+	}
+	blocks = reverse_slice(blocks)
+	if len(blocks) > limit {
+		return append(blocks[:limit-1], blocks[len(blocks)-1])
+	}
+	return blocks
+}
+
+// Blockchain's method median_time_past returns the median timestamp of the block with the given hash and up to
+// median_time_span - 1 of its ancestors. returns 0 for the zero hash that comes before the genisys node
+func (blockchain Blockchain) median_time_past(block_hash Hash) int64 {
+	timestamps := make([]int64, 0, median_time_span)
+	block, ok := blockchain.Blocks[block_hash]
+	for ok && len(timestamps) < median_time_span {
+		timestamps = append(timestamps, block.Timestamp)
+		block, ok = blockchain.Blocks[block.Prev_Block]
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2]
+}
+
+// Blockchain's method check_block_context checks the rules of a block that depend on its previous block, which must
+// be in the blockchain: the height follows the previous block's height and the timestamp is after the median time
+// past of the previous block. a genisys node other than the one of the chain parameters is rejected, so that chains
+// of other networks are never added
+func (blockchain Blockchain) check_block_context(block Block) error {
+	if block.Prev_Block == (Hash{}) {
+		return fmt.Errorf("block is not rooted at the genisys node %s of the chain", blockchain.Chain_Id.to_string())
+	}
+	prev_block, ok := blockchain.Blocks[block.Prev_Block]
+	if !ok {
+		return fmt.Errorf("previous block %s is missing", block.Prev_Block.to_string())
+	}
+	if block.Height != prev_block.Height+1 {
+		return fmt.Errorf("height %d does not follow height %d of the previous block", block.Height, prev_block.Height)
+	}
+	if median_time := blockchain.median_time_past(block.Prev_Block); block.Timestamp <= median_time {
+		return fmt.Errorf("timestamp %d is not after the median time past %d", block.Timestamp, median_time)
+	}
+	if trailing_zeros := blockchain.next_trailing_zeros(block.Prev_Block); block.Trailing_Zeros != trailing_zeros {
+		return fmt.Errorf("block requires %d trailing zeros instead of %d", trailing_zeros, block.Trailing_Zeros)
+	}
+	if checkpoint, ok := blockchain.Params.Checkpoints[block.Height]; ok && checkpoint != block.hashed() {
+		return fmt.Errorf("%w at height %d", err_checkpoint_conflict, block.Height)
+	}
+	return nil
+}
+
+// Blockchain's method check_finality checks that a block about to be added does not fork off the best chain below a
+// checkpoint the blockchain holds or more than the finality depth below the tip, since the branch it starts could
+// only become the best chain by reorganizing blocks that are final
+func (blockchain Blockchain) check_finality(block Block) error {
+	tip, ok := blockchain.Blocks[blockchain.Tip]
+	if !ok || block.Prev_Block == blockchain.Tip {
+		return nil
+	}
+	fork_height := blockchain.Blocks[blockchain.find_fork(block.Prev_Block, blockchain.Tip)].Height
+	for height, checkpoint := range blockchain.Params.Checkpoints {
+		if _, known := blockchain.Blocks[checkpoint]; known && height > fork_height {
+			return fmt.Errorf("%w at height %d", err_checkpoint_conflict, height)
 		}
 	}
-	return best_block.hashed()
+	if depth := tip.Height - fork_height; blockchain.Params.Finality_Depth > 0 && depth > blockchain.Params.Finality_Depth {
+		return fmt.Errorf("%w: %d blocks would be disconnected", err_beyond_finality, depth)
+	}
+	return nil
 }
 
-// blockchain's method is_valid_blocks checks whether each block is itself valid and
-// all the blocks together make a single chain
+// Blockchain's method next_trailing_zeros returns the trailing zero bits required of the block that follows the block
+// with the given hash. the difficulty is retargeted once every Retarget_Interval blocks: a trailing zero bit is added
+// for each time the last interval was mined twice as fast as Target_Block_Time and removed for each time it took twice
+// as long, clamped to Max_Retarget_Step bits and never going below Min_Trailing_Zeros. the first interval starts with
+// the genisys node, whose timestamp says nothing about how fast blocks are mined, so it keeps the initial difficulty
+func (blockchain Blockchain) next_trailing_zeros(prev_hash Hash) int {
+	params := blockchain.Params
+	prev_block, ok := blockchain.Blocks[prev_hash]
+	if !ok {
+		return params.Initial_Trailing_Zeros
+	}
+	if params.Retarget_Interval < 2 || prev_block.Height%params.Retarget_Interval != 0 {
+		return prev_block.Trailing_Zeros
+	}
+
+	first_block := prev_block
+	for i := uint64(1); i < params.Retarget_Interval; i++ {
+		first_block = blockchain.Blocks[first_block.Prev_Block]
+	}
+	if first_block.Prev_Block == (Hash{}) {
+		return prev_block.Trailing_Zeros
+	}
+	expected := int64(params.Retarget_Interval-1) * params.Target_Block_Time
+	actual := max(prev_block.Timestamp-first_block.Timestamp, 1)
+
+	step := 0
+	for ; step < params.Max_Retarget_Step && 2*actual <= expected; step++ {
+		actual *= 2
+	}
+	for ; step > -params.Max_Retarget_Step && actual >= 2*expected; step-- {
+		expected *= 2
+	}
+	return max(prev_block.Trailing_Zeros+step, params.Min_Trailing_Zeros)
+}
+
+// Blockchain's method compute_ledger applies the transactions of every block in the best chain after the genisys
+// node to a ledger holding the initial balances of the given chain parameters. returns an error if any transaction
+// can not be applied
+func (blockchain Blockchain) compute_ledger(params ChainParams) (Ledger, error) {
+	ledger := create_ledger(params)
+	for _, block := range blockchain.best_chain()[1:] {
+		if err := ledger.connect_block(block.hashed(), blockchain.Merkel_Trees[block.Merkel_Root]); err != nil {
+			return ledger, fmt.Errorf("block %s: %v", block.hashed().to_string(), err)
+		}
+	}
+	return ledger, nil
+}
+
+// Blockchain's method copy returns a blockchain holding the same blocks and merkel trees that can be changed independently
+func (blockchain Blockchain) copy() Blockchain {
+	out := __empty_blockchain(blockchain.Params)
+	for block_hash, block := range blockchain.Blocks {
+		out.Blocks[block_hash] = block
+		out.Chain_Work[block_hash] = blockchain.Chain_Work[block_hash]
+	}
+	for merkel_tree_hash, merkel_tree := range blockchain.Merkel_Trees {
+		out.Merkel_Trees[merkel_tree_hash] = merkel_tree
+	}
+	for block_hash, children := range blockchain.Children {
+		out.Children[block_hash] = append([]Hash{}, children...)
+	}
+	for block_hash := range blockchain.Branch_Points {
+		out.Branch_Points[block_hash] = true
+	}
+	for block_hash := range blockchain.Leaves {
+		out.Leaves[block_hash] = true
+	}
+	for merkel_root, refs := range blockchain.Merkel_Tree_Refs {
+		out.Merkel_Tree_Refs[merkel_root] = refs
+	}
+	out.Tip, out.Chain_Id = blockchain.Tip, blockchain.Chain_Id
+	return out
+}
+
+// blockchain's method is_valid_blocks checks whether each block is itself valid and follows its previous block,
+// so that all the blocks together make a tree rooted at the genisys node. the genisys node is not mined, it is
+// valid for being the one the chain parameters define
 func (blockchain Blockchain) is_valid_blocks() bool {
-	dp := blockchain.__calc_block_length_values()
-	max_length := -1
+	if _, ok := blockchain.Blocks[blockchain.Chain_Id]; !ok {
+		return false
+	}
 	for block_hash, block := range blockchain.Blocks {
-		if !block.is_valid() {
-			return false
+		if block_hash == blockchain.Chain_Id {
+			continue
 		}
-		length := (*dp)[block_hash]
-		if length > max_length {
-			max_length = length
+		if !block.is_valid() || blockchain.check_block_context(block) != nil {
+			return false
 		}
 	}
-	return max_length == len(blockchain.Blocks)
+	return true
+}
+
+// blockchain's method is_single_chain returns true if the blockchain holds no side branches
+func (blockchain Blockchain) is_single_chain() bool {
+	return blockchain.Blocks[blockchain.Tip].Height == uint64(len(blockchain.Blocks))
 }
 
 // Blockchain's method is_valid_merkel_trees checks whether all the merkel trees are valid
@@ -116,89 +463,82 @@ func (blockchain Blockchain) is_valid() bool {
 }
 
 // blockchain's function remove_short_chains removes all the chains (along with their merkel trees)
-// starting from the genisys node except the longest one. has no effect if there is already a single chain
+// starting from the genisys node except the one with the most cumulative work. has no effect if there is already a single chain
 func (blockchain *Blockchain) remove_short_chains() {
-	dp := blockchain.__calc_block_length_values()
-	max_length, best_block := -1, Block{}
-	for block_hash, block := range blockchain.Blocks {
-		length := (*dp)[block_hash]
-		if length > max_length {
-			max_length = length
-			best_block = block
-		}
-	}
-	to_keep_blocks := make(map[Hash]Block)
-	to_keep_merkel_trees := make(map[Hash]MerkelTree)
-	for {
-		to_keep_blocks[best_block.hashed()] = best_block
-		to_keep_merkel_trees[best_block.Merkel_Root] = blockchain.Merkel_Trees[best_block.Merkel_Root]
-		if best_block.Prev_Block == (Hash{}) {
+	blockchain.prune_side_branches(0)
+}
+
+// Blockchain's method prune_side_branches removes the side branches (along with their merkel trees) that forked off
+// the best chain more than depth blocks below its tip. a side branch is kept or removed as a whole
+func (blockchain *Blockchain) prune_side_branches(depth uint64) {
+	tip, ok := blockchain.Blocks[blockchain.Tip]
+	if !ok || len(blockchain.Branch_Points) == 0 {
+		return
+	}
+	lowest := tip.Height
+	for block_hash := range blockchain.Branch_Points {
+		lowest = min(lowest, blockchain.Blocks[block_hash].Height) // the zero hash before the genisys nodes has height 0
+	}
+	// walk down the best chain to the lowest branch point, removing the branches built on each block that is too deep
+	block_hash, best_child, block := blockchain.Tip, Hash{}, tip
+	for block.Height >= lowest {
+		if tip.Height-block.Height > depth {
+			for _, child := range append([]Hash{}, blockchain.Children[block_hash]...) {
+				if child != best_child {
+					blockchain.__remove_branch(child)
+				}
+			}
+		}
+		if block_hash == (Hash{}) {
 			break
 		}
-		best_block = blockchain.Blocks[best_block.Prev_Block]
+		best_child, block_hash = block_hash, block.Prev_Block
+		block = blockchain.Blocks[block_hash] // the zero hash before the genisys nodes has height 0
+	}
+}
+
+// Blockchain's private method __remove_branch removes the block with the given hash and every block built on it
+func (blockchain *Blockchain) __remove_branch(root_hash Hash) {
+	branch := []Hash{root_hash}
+	for i := 0; i < len(branch); i++ {
+		branch = append(branch, blockchain.Children[branch[i]]...)
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		blockchain.remove_block(blockchain.Blocks[branch[i]])
 	}
-	blockchain.Blocks = to_keep_blocks
-	blockchain.Merkel_Trees = to_keep_merkel_trees
 }
 
 func (blockchain Blockchain) pretty_print_blocks() string {
 	if !blockchain.is_valid_blocks() {
 		return "-- Invalid Blockchain --"
 	}
-	dp := blockchain.__calc_block_length_values()
-	max_length, best_block := -1, Block{}
-	for block_hash, block := range blockchain.Blocks {
-		length := (*dp)[block_hash]
-		if length > max_length {
-			max_length = length
-			best_block = block
-		}
-	}
-	ordered_blocks := make([]Block, max_length)
-	for {
-		ordered_blocks[max_length-1] = best_block
-		if best_block.Prev_Block == (Hash{}) {
-			break
-		}
-		best_block = blockchain.Blocks[best_block.Prev_Block]
-		max_length--
-	}
-	out := "Blocks in order:\n"
-	for idx, block := range ordered_blocks {
-		block_hash := block.hashed()
-		out += fmt.Sprintf("%.2d) Prev Block: %s\n    Merkel Root: %s\n    Nonce: %s\n    Hash: %s\n\n", idx+1, block.Prev_Block.to_string(), block.Merkel_Root.to_string(), block.Nonce.to_string(), block_hash.to_string())
-	}
-	return out
+	return blockchain.print_best_chain(false)
 }
 
 func (blockchain Blockchain) pretty_print() string {
 	if !blockchain.is_valid() {
 		return "-- Invalid Blockchain --"
 	}
-	dp := blockchain.__calc_block_length_values()
-	max_length, best_block := -1, Block{}
-	for block_hash, block := range blockchain.Blocks {
-		length := (*dp)[block_hash]
-		if length > max_length {
-			max_length = length
-			best_block = block
-		}
-	}
-	ordered_blocks := make([]Block, max_length)
-	for {
-		ordered_blocks[max_length-1] = best_block
-		if best_block.Prev_Block == (Hash{}) {
-			break
-		}
-		best_block = blockchain.Blocks[best_block.Prev_Block]
-		max_length--
-	}
-	out := "Blocks in order:\n"
-	for idx, block := range ordered_blocks {
+	return blockchain.print_best_chain(true)
+}
+
+// Blockchain's method print_best_chain prints the blocks of the best chain in order, each followed by its merkel tree
+// if with_merkel_trees. unlike pretty_print the blockchain is not validated first, so it suits a blockchain whose
+// blocks were checked as they were added
+func (blockchain Blockchain) print_best_chain(with_merkel_trees bool) string {
+	var out strings.Builder
+	out.WriteString("Blocks in order:\n")
+	chain_work := big.NewInt(0)
+	for idx, block := range blockchain.best_chain() {
 		block_hash := block.hashed()
-		out += fmt.Sprintf("%.2d) Prev Block: %s\n    Merkel Root: %s\n    Nonce: %s\n    Hash: %s\n", idx+1, block.Prev_Block.to_string(), block.Merkel_Root.to_string(), block.Nonce.to_string(), block_hash.to_string())
-		merkel_tree := blockchain.Merkel_Trees[block.Merkel_Root]
-		out += merkel_tree.pretty_print()
+		chain_work.Add(chain_work, block.work())
+		fmt.Fprintf(&out, "%.2d) Height: %d\n    Timestamp: %s\n    Prev Block: %s\n    Merkel Root: %s\n    Nonce: %s\n    Trailing Zeros: %d\n    Chain Work: %s\n    Hash: %s\n", idx+1, block.Height, time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339), block.Prev_Block.to_string(), block.Merkel_Root.to_string(), block.Nonce.to_string(), block.Trailing_Zeros, chain_work.String(), block_hash.to_string())
+		if with_merkel_trees {
+			merkel_tree := blockchain.Merkel_Trees[block.Merkel_Root]
+			out.WriteString(merkel_tree.pretty_print())
+		} else {
+			out.WriteString("\n")
+		}
 	}
-	return out
+	return out.String()
 }
@@ -0,0 +1,26 @@
+package main
+
+// constants for the ledger modes a chain can run in
+const (
+	ledger_mode_account = iota // transactions move balances between accounts and carry per account nonces
+	ledger_mode_utxo    = iota // transactions spend outputs of earlier transactions and create new outputs
+)
+
+// Type ChainParams holds the consensus rules that every peer of a network has to agree on
+type ChainParams struct {
+	Network_Id        string // name of the network, part of the genisys node
+	Genesis_Timestamp int64  // unix time of the genisys node
+	Ledger_Mode       int
+	Initial_Balances  map[string]uint64 // {account: balance} before the first block
+	Block_Reward      uint64            // amount the coinbase of every block creates, on top of the block's fees
+	Coinbase_Maturity uint64            // number of blocks after which a coinbase can be spent
+
+	Initial_Trailing_Zeros int    // trailing zero bits of the genisys node, required of every block until the first retarget
+	Min_Trailing_Zeros     int    // a retarget never requires fewer trailing zero bits than this
+	Target_Block_Time      int64  // seconds the network aims to spend on each block
+	Retarget_Interval      uint64 // number of blocks between retargets, 0 keeps the initial difficulty forever
+	Max_Retarget_Step      int    // most trailing zero bits a single retarget may add or remove
+
+	Checkpoints    map[uint64]Hash // {height: hash of the only block accepted at that height}
+	Finality_Depth uint64          // blocks this deep below the tip can no longer be reorganized, 0 to allow any reorg
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const cli_usage = `usage: blockchain <command> [flags]
+
+commands:
+  run-scenario   run one of the built in multi peer scenarios
+  node           run a single peer that joins an existing network
+  bootstrap      run a single bootstrap peer
+  inspect-chain  print the blockchain stored in a peer's data directory
+  verify         check whether the blockchain stored in a peer's data directory is valid
+  keygen         create a key seed for the -key flag and print its account address
+  wallet         manage keys and send transactions (new, list, import, export, balance, send)
+  mempool        print the pending transactions of a running peer
+
+run 'blockchain <command> -h' for the flags of a command
+`
+
+// function run_cli parses the command line arguments and runs the requested command. returns the exit code
+func run_cli(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cli_usage)
+		return 2
+	}
+	switch args[0] {
+	case "run-scenario":
+		return command_run_scenario(args[1:])
+	case "node":
+		return command_node(args[1:], false)
+	case "bootstrap":
+		return command_node(args[1:], true)
+	case "inspect-chain":
+		return command_inspect_chain(args[1:])
+	case "verify":
+		return command_verify(args[1:])
+	case "keygen":
+		return command_keygen(args[1:])
+	case "wallet":
+		return command_wallet(args[1:])
+	case "mempool":
+		return command_mempool(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, cli_usage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], cli_usage)
+	return 2
+}
+
+// function command_run_scenario runs one of the functions in Scenarios.go
+func command_run_scenario(args []string) int {
+	flags := flag.NewFlagSet("run-scenario", flag.ContinueOnError)
+	scenario_number := flags.Int("scenario", 0, "scenario to run (0: connection control, 1: blockchain observation, 2: bad node)")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	switch *scenario_number {
+	case 0:
+		scenario_connection_control()
+	case 1:
+		scenario_blockchain_observation()
+	case 2:
+		scenario_blockchain_bad_node()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown scenario %d\n", *scenario_number)
+		return 2
+	}
+	return 0
+}
+
+// function command_node runs a single peer whose configuration is populated from the command line flags.
+// the peer's reports are written to stdout or a log file and the peer leaves the network on SIGINT or SIGTERM
+func command_node(args []string, is_bootstrap bool) int {
+	name := "node"
+	if is_bootstrap {
+		name = "bootstrap"
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	listen := flags.String("listen", "localhost:8080", "host:port the peer listens on and announces to others")
+	bootstrap := flags.String("bootstrap", "localhost:8080", "host:port of the bootstrap peer (ignored for bootstrap)")
+	transaction_per_block := flags.Int("tx-per-block", 4, "transactions in each mined block")
+	max_neighbours := flags.Int("max-neighbours", 3, "maximum number of neighbours")
+	die_after := flags.Int64("die-after", -1, "seconds after which the peer leaves the network (-1 to never leave)")
+	is_miner := flags.Bool("miner", false, "mine blocks")
+	is_transaction_maker := flags.Bool("tx-maker", false, "create random transactions")
+	is_bad_node := flags.Bool("bad-node", false, "refuse blocks mined by other peers")
+	side_branch_depth := flags.Uint64("side-branch-depth", 20, "keep side branches that forked at most this many blocks below the tip")
+	mempool_limits := default_mempool_limits()
+	mempool_max_count := flags.Int("mempool-max-count", mempool_limits.Max_Count, "pending transactions kept at most, the ones paying the least per byte are evicted first")
+	mempool_max_bytes := flags.Int("mempool-max-bytes", mempool_limits.Max_Bytes, "bytes of pending transactions kept at most")
+	mempool_expiry := flags.Int64("mempool-expiry", mempool_limits.Expiry, "seconds a pending transaction is kept without being included in a block")
+	data_dir := flags.String("data-dir", "", "directory the blocks are stored in and reloaded from on restart (default keep them in memory only)")
+	reports := flags.String("reports", "transaction_created,block_mined,blockchain_updated,reorg,rejected_reorg,dropped_packets,handshake,sync,compact_blocks,mempool", "comma separated report types to log")
+	log_file := flags.String("log", "", "file the reports are appended to (default stdout)")
+	chain_params_from_flags := add_chain_param_flags(flags)
+	key := flags.String("key", "", "hex encoded key seed the peer signs its transactions with (default a random key)")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	chain_params, err := chain_params_from_flags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	private_key := generate_key()
+	if *key != "" {
+		if private_key, err = key_from_seed(*key); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	to_print, err := parse_report_types(*reports)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	self_address, err := parse_address(*listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -listen address: %v\n", err)
+		return 2
+	}
+	bootstrap_address := Address{}
+	if !is_bootstrap {
+		bootstrap_address, err = parse_address(*bootstrap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -bootstrap address: %v\n", err)
+			return 2
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *log_file != "" {
+		file, err := os.OpenFile(*log_file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open log file: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	report_channel := make(chan ReportToMain, 100)
+	logger_done := make(chan struct{})
+	go func() {
+		log_reports(report_channel, to_print, out)
+		close(logger_done)
+	}()
+
+	quit := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(quit)
+	}()
+
+	fmt.Fprintf(out, "%s %v account: %s\n", time.Now().Format(time.RFC3339), self_address.to_string(), address_from_key(private_key))
+	fmt.Fprintf(out, "%s %v network: %s chain: %s\n", time.Now().Format(time.RFC3339), self_address.to_string(), chain_params.Network_Id, chain_params.chain_id().to_string())
+
+	peer_config := PeerConfig{
+		Self_Address:          self_address,
+		Is_Bootstrap:          is_bootstrap,
+		Is_Miner:              *is_miner,
+		Is_Transaction_Maker:  *is_transaction_maker,
+		Bootstrap_Address:     bootstrap_address,
+		Transaction_Per_Block: *transaction_per_block,
+		Max_Neighbours:        *max_neighbours,
+		Die_After:             *die_after,
+		Up_Channel:            report_channel,
+		Is_Bad_Node:           *is_bad_node,
+		Data_Dir:              *data_dir,
+		Quit_Channel:          quit,
+		Chain_Params:          chain_params,
+		Private_Key:           private_key,
+		Side_Branch_Depth:     *side_branch_depth,
+		Mempool_Limits:        MempoolLimits{Max_Count: *mempool_max_count, Max_Bytes: *mempool_max_bytes, Expiry: *mempool_expiry},
+	}
+
+	peer_main(peer_config) // returns once the peer leaves the network
+	close(report_channel)
+	<-logger_done
+	return 0
+}
+
+// function command_inspect_chain prints the blockchain stored in a peer's data directory
+func command_inspect_chain(args []string) int {
+	flags := flag.NewFlagSet("inspect-chain", flag.ContinueOnError)
+	data_dir := flags.String("data-dir", "", "data directory of the peer whose blockchain is inspected")
+	blocks_only := flags.Bool("blocks-only", false, "do not print the merkel trees of the blocks")
+	chain_params_from_flags := add_chain_param_flags(flags)
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	chain_params, err := chain_params_from_flags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	blockchain, _, err := load_blockchain(*data_dir, chain_params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load %q: %v\n", *data_dir, err)
+		return 1
+	}
+	if *blocks_only {
+		fmt.Print(blockchain.pretty_print_blocks())
+	} else {
+		fmt.Print(blockchain.pretty_print())
+	}
+	return 0
+}
+
+// function command_verify checks the blockchain stored in a peer's data directory and exits with a non zero code if it is invalid
+func command_verify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	data_dir := flags.String("data-dir", "", "data directory of the peer whose blockchain is verified")
+	chain_params_from_flags := add_chain_param_flags(flags)
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	chain_params, err := chain_params_from_flags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	blockchain, rejected, err := load_blockchain(*data_dir, chain_params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load %q: %v\n", *data_dir, err)
+		return 1
+	}
+	if rejected > 0 {
+		fmt.Printf("invalid: %d stored blocks break the chain rules\n", rejected)
+		return 1
+	}
+	if !blockchain.is_valid_blocks() || !blockchain.is_single_chain() {
+		fmt.Println("invalid: blocks do not form a single valid chain")
+		return 1
+	}
+	if !blockchain.is_valid_merkel_trees() {
+		fmt.Println("invalid: a merkel tree is missing or invalid")
+		return 1
+	}
+	for _, merkel_tree := range blockchain.Merkel_Trees {
+		if !merkel_tree.has_valid_signatures() {
+			fmt.Println("invalid: a transaction is not signed by its sender")
+			return 1
+		}
+	}
+	if _, err := blockchain.compute_ledger(chain_params); err != nil {
+		fmt.Printf("invalid: %v\n", err)
+		return 1
+	}
+	tip := blockchain.get_last_hash()
+	fmt.Printf("valid: %d blocks, work %s, tip %s, chain %s\n", len(blockchain.Blocks), blockchain.chain_work(tip).String(), tip.to_string(), blockchain.Chain_Id.to_string())
+	return 0
+}
+
+// function command_keygen prints a new random key seed and the account address it owns
+func command_keygen(args []string) int {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	private_key := generate_key()
+	fmt.Printf("seed: %s\naddress: %s\n", key_seed(private_key), address_from_key(private_key))
+	return 0
+}
+
+// function command_mempool asks a running peer for its pending transactions and prints them along with a summary of
+// its pool, the transactions paying the highest fee per byte first or in the order they apply in for a single address
+func command_mempool(args []string) int {
+	flags := flag.NewFlagSet("mempool", flag.ContinueOnError)
+	peer := flags.String("peer", "localhost:8080", "host:port of the peer whose pool is printed")
+	address := flags.String("address", "", "print only the transactions sent from this address")
+	chain_params_from_flags := add_chain_param_flags(flags)
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	chain_params, err := chain_params_from_flags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	target, err := parse_address(*peer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -peer address: %v\n", err)
+		return 2
+	}
+
+	conn, err := net.DialTimeout("tcp", target.to_string(), connection_io_timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to %s: %v\n", target.to_string(), err)
+		return 1
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connection_io_timeout))
+	request := NetworkPacket{Header: create_packet_header(chain_params.chain_id()), Message: GetMempoolMessage{Address: *address}}
+	if err := write_frame(conn, request); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send the request: %v\n", err)
+		return 1
+	}
+	response, err := read_frame(conn, chain_params.Min_Trailing_Zeros)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "no answer from %s: %v\n", target.to_string(), err)
+		return 1
+	}
+	mempool, ok := response.Message.(MempoolMessage)
+	if !ok || response.Header != request.Header {
+		fmt.Fprintf(os.Stderr, "unexpected answer from %s, is it on the same chain?\n", target.to_string())
+		return 1
+	}
+	fmt.Println(mempool.Stats.to_string())
+	for _, transaction := range mempool.Transactions {
+		fmt.Printf("%s %s\n", transaction.hashed().to_string(), transaction.to_string())
+	}
+	return 0
+}
+
+const wallet_usage = `usage: blockchain wallet <command> [flags]
+
+commands:
+  new      add a new key to the wallet (new and import create the wallet file if it does not exist)
+  list     print the addresses in the wallet
+  import   add a key from its hex encoded seed
+  export   print the hex encoded seed of a key
+  balance  print the balances of the wallet's addresses in a peer's stored blockchain
+  send     build and sign a transaction and submit it to a running peer
+
+the passphrase is taken from the -passphrase flag or the BLOCKCHAIN_WALLET_PASSPHRASE environment variable
+`
+
+// function command_wallet runs one of the wallet commands
+func command_wallet(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, wallet_usage)
+		return 2
+	}
+	flags := flag.NewFlagSet("wallet "+args[0], flag.ContinueOnError)
+	wallet_file := flags.String("wallet", "wallet.dat", "encrypted wallet file")
+	passphrase := flags.String("passphrase", os.Getenv("BLOCKCHAIN_WALLET_PASSPHRASE"), "passphrase the wallet is encrypted with")
+	label := flags.String("label", "", "label of the new or imported key")
+	seed := flags.String("seed", "", "hex encoded seed of the key to import")
+	address := flags.String("address", "", "address to use (default the first key for export and send, every key for balance)")
+	data_dir := flags.String("data-dir", "", "data directory of the peer whose blockchain the balances and nonces are read from")
+	chain_params_from_flags := add_chain_param_flags(flags)
+	to := flags.String("to", "", "address to pay")
+	amount := flags.Uint64("amount", 0, "amount to pay")
+	fee := flags.Uint64("fee", 1, "fee to pay")
+	memo := flags.String("memo", "", "memo of the transaction")
+	nonce := flags.Int64("nonce", -1, "nonce of the transaction in the account ledger mode (default the next nonce in the stored blockchain)")
+	peer := flags.String("peer", "localhost:8080", "host:port of the peer the transaction is submitted to")
+	if flags.Parse(args[1:]) != nil {
+		return 2
+	}
+	if *passphrase == "" {
+		fmt.Fprintln(os.Stderr, "a passphrase is required")
+		return 2
+	}
+
+	wallet, err := load_wallet(*wallet_file, *passphrase)
+	if err != nil && !((args[0] == "new" || args[0] == "import") && errors.Is(err, os.ErrNotExist)) {
+		fmt.Fprintf(os.Stderr, "failed to open wallet: %v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "new", "import":
+		new_address := ""
+		if args[0] == "new" {
+			new_address = wallet.new_key(*label)
+		} else if new_address, err = wallet.import_key(*seed, *label); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := wallet.save(*wallet_file, *passphrase); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save wallet: %v\n", err)
+			return 1
+		}
+		fmt.Println(new_address)
+	case "list":
+		for _, key := range wallet.Keys {
+			fmt.Printf("%s %s\n", key.Address, key.Label)
+		}
+	case "export":
+		exported, err := wallet.export_key(*address)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(exported)
+	case "balance", "send":
+		chain_params, err := chain_params_from_flags()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		blockchain, _, err := load_blockchain(*data_dir, chain_params)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load %q: %v\n", *data_dir, err)
+			return 1
+		}
+		ledger, err := blockchain.compute_ledger(chain_params)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid blockchain: %v\n", err)
+			return 1
+		}
+		if args[0] == "balance" {
+			for _, key := range wallet.Keys {
+				if *address == "" || key.Address == *address {
+					fmt.Printf("%s %d (immature %d)\n", key.Address, ledger.get_balance(key.Address), ledger.get_immature_balance(key.Address))
+				}
+			}
+			return 0
+		}
+
+		private_key, ok := wallet.find_key(*address)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no key for %q in the wallet\n", *address)
+			return 1
+		}
+		target, err := parse_address(*peer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -peer address: %v\n", err)
+			return 2
+		}
+		transaction, err := create_payment(ledger, private_key, *to, *amount, *fee, *nonce, *memo)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		packet := NetworkPacket{Header: create_packet_header(blockchain.Chain_Id), Message: SubmitTransactionMessage{Transaction: transaction}}
+		if err := __send_request(packet, target); err != nil {
+			return 1
+		}
+		fmt.Printf("submitted %s\n", transaction.hashed().to_string())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown wallet command %q\n\n%s", args[0], wallet_usage)
+		return 2
+	}
+	return 0
+}
+
+// function parse_report_types converts a comma separated list of report names to their report types
+func parse_report_types(names string) ([]int, error) {
+	to_print := make([]int, 0, len(report_type_names))
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		report_type, ok := report_type_names[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown report type %q", name)
+		}
+		to_print = append(to_print, report_type)
+	}
+	return to_print, nil
+}
+
+// function add_chain_param_flags registers the flags of the consensus rules, which must match on every peer of a
+// network, on the given flag set. the returned function builds the chain parameters once the flags are parsed. a
+// genesis config file replaces the network id, initial balances and initial difficulty given by the other flags
+func add_chain_param_flags(flags *flag.FlagSet) func() (ChainParams, error) {
+	genesis := flags.String("genesis", "", "json file defining the genisys node (Network_Id, Timestamp, Trailing_Zeros, Allocations)")
+	network_id := flags.String("network-id", "local", "name of the network, part of the genisys node")
+	allocations := flags.String("alloc", "", "comma separated account=balance initial balances")
+	ledger := flags.String("ledger", "account", "ledger mode of the chain (account or utxo)")
+	block_reward := flags.Uint64("block-reward", 50, "amount paid to the miner of each block on top of its fees")
+	coinbase_maturity := flags.Uint64("coinbase-maturity", 3, "blocks after which a block reward can be spent")
+	trailing_zeros := flags.Int("trailing-zeros", 20, "trailing zero bits required in a block hash until the first retarget")
+	min_trailing_zeros := flags.Int("min-trailing-zeros", 8, "trailing zero bits a retarget never goes below")
+	block_time := flags.Int64("block-time", 10, "seconds the difficulty is retargeted to spend on each block")
+	retarget_interval := flags.Uint64("retarget-interval", 10, "blocks between difficulty retargets (0 to never retarget)")
+	max_retarget_step := flags.Int("max-retarget-step", 2, "most trailing zero bits a single retarget may add or remove")
+	checkpoints := flags.String("checkpoints", "", "comma separated height=hash blocks the chain has to contain")
+	finality_depth := flags.Uint64("finality-depth", 100, "blocks this deep below the tip can not be reorganized (0 to allow any reorg)")
+	return func() (ChainParams, error) {
+		initial_balances, err := parse_allocations(*allocations)
+		if err != nil {
+			return ChainParams{}, err
+		}
+		parsed_checkpoints, err := parse_checkpoints(*checkpoints)
+		if err != nil {
+			return ChainParams{}, err
+		}
+		params := ChainParams{
+			Network_Id:             *network_id,
+			Genesis_Timestamp:      default_genesis_timestamp,
+			Initial_Balances:       initial_balances,
+			Block_Reward:           *block_reward,
+			Coinbase_Maturity:      *coinbase_maturity,
+			Initial_Trailing_Zeros: *trailing_zeros,
+			Min_Trailing_Zeros:     *min_trailing_zeros,
+			Target_Block_Time:      *block_time,
+			Retarget_Interval:      *retarget_interval,
+			Max_Retarget_Step:      *max_retarget_step,
+			Checkpoints:            parsed_checkpoints,
+			Finality_Depth:         *finality_depth,
+		}
+		if *genesis != "" {
+			config, err := load_genesis_config(*genesis)
+			if err != nil {
+				return ChainParams{}, fmt.Errorf("invalid genesis config: %v", err)
+			}
+			params.Network_Id, params.Genesis_Timestamp = config.Network_Id, config.Timestamp
+			params.Initial_Balances, params.Initial_Trailing_Zeros = config.Allocations, config.Trailing_Zeros
+		}
+		if params.Min_Trailing_Zeros > params.Initial_Trailing_Zeros || params.Target_Block_Time <= 0 || params.Max_Retarget_Step < 0 {
+			return ChainParams{}, errors.New("invalid difficulty settings")
+		}
+		switch *ledger {
+		case "account":
+			params.Ledger_Mode = ledger_mode_account
+		case "utxo":
+			params.Ledger_Mode = ledger_mode_utxo
+		default:
+			return ChainParams{}, fmt.Errorf("unknown ledger mode %q", *ledger)
+		}
+		return params, nil
+	}
+}
+
+// function parse_checkpoints converts a comma separated list of height=hash pairs to a map
+func parse_checkpoints(value string) (map[uint64]Hash, error) {
+	checkpoints := make(map[uint64]Hash)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		height, hash, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("checkpoint %q is not in height=hash form", pair)
+		}
+		parsed_height, err := strconv.ParseUint(height, 10, 64)
+		if err != nil || parsed_height == 0 {
+			return nil, fmt.Errorf("checkpoint %q has an invalid height", pair)
+		}
+		parsed_hash, err := parse_hash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %q has an invalid hash", pair)
+		}
+		checkpoints[parsed_height] = parsed_hash
+	}
+	return checkpoints, nil
+}
+
+// function parse_allocations converts a comma separated list of account=balance pairs to a map
+func parse_allocations(value string) (map[string]uint64, error) {
+	allocations := make(map[string]uint64)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		separator := strings.LastIndex(pair, "=")
+		if separator == -1 {
+			return nil, fmt.Errorf("allocation %q is not in account=balance form", pair)
+		}
+		balance, err := strconv.ParseUint(pair[separator+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("allocation %q has an invalid balance", pair)
+		}
+		if !is_valid_address(pair[:separator]) {
+			return nil, fmt.Errorf("allocation %q has an invalid address", pair)
+		}
+		allocations[pair[:separator]] = balance
+	}
+	return allocations, nil
+}
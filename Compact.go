@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// bytes of a short transaction id
+const short_id_size = 6
+
+// seconds a compact block waits for its missing transactions before it is dropped
+const partial_block_timeout = 30
+
+// Type PrefilledTransaction holds a transaction sent whole in a compact block along with its leaf index
+type PrefilledTransaction struct {
+	Index       uint32
+	Transaction Transaction
+}
+
+// Type PartialBlock holds a compact block whose missing transactions were asked of the neighbour that sent it
+type PartialBlock struct {
+	Block        Block
+	Transactions []Transaction // in the order of the leaves, transactions that did not arrive yet are not Not_Null
+	From         Address
+	Received_At  int64
+	Bytes        int // bytes of the compact block
+}
+
+// Type CompactBlockStats counts the blocks a peer received as compact blocks and the bandwidth they saved
+type CompactBlockStats struct {
+	Blocks        uint64 // compact blocks turned into full blocks
+	Reconstructed uint64 // compact blocks rebuilt from the peer's own transactions without asking for any
+	Requested     uint64 // transactions asked of the senders of compact blocks
+	Failed        uint64 // compact blocks that could not be rebuilt and were asked for in full
+	Compact_Bytes uint64 // bytes of the compact blocks and block transactions that made the blocks
+	Full_Bytes    uint64 // bytes the same blocks take when sent in full
+}
+
+func (stats CompactBlockStats) to_string() string {
+	saved := int64(stats.Full_Bytes) - int64(stats.Compact_Bytes)
+	percent := int64(0)
+	if stats.Full_Bytes > 0 {
+		percent = saved * 100 / int64(stats.Full_Bytes)
+	}
+	return fmt.Sprintf("%d blocks (%d from own transactions, %d failed), %d transactions requested, %d bytes instead of %d, saved %d (%d%%)",
+		stats.Blocks, stats.Reconstructed, stats.Failed, stats.Requested, stats.Compact_Bytes, stats.Full_Bytes, saved, percent)
+}
+
+// function short_id_key returns the key the short ids of the transactions of the given block are made with, the nonce
+// makes the ids differ between senders so that a collision can not be made for every peer at once
+func short_id_key(block Block, nonce uint64) Hash {
+	return Hash{Value: sha256.Sum256(binary.BigEndian.AppendUint64(block.encode_header(), nonce))}
+}
+
+// function short_id returns the short id of the transaction with the given hash: the first short_id_size bytes of
+// the sha256 of the key followed by the transaction hash
+func short_id(key Hash, transaction_hash Hash) uint64 {
+	sum := sha256.Sum256(append(key.Value[:], transaction_hash.Value[:]...))
+	return binary.BigEndian.Uint64(append(make([]byte, 8-short_id_size), sum[:short_id_size]...))
+}
+
+// function create_compact_block returns the compact form of the given block. the coinbase is sent whole since no
+// other peer has it, every other transaction is sent as its short id
+func create_compact_block(block Block, merkel_tree MerkelTree) CompactBlockMessage {
+	message := CompactBlockMessage{Block: block, Nonce: uint64(random_int(0, 1<<62)), Short_Ids: make([]uint64, 0), Prefilled: make([]PrefilledTransaction, 0)}
+	key := short_id_key(block, message.Nonce)
+	for idx, transaction := range merkel_tree.ordered_transactions() {
+		if transaction.Is_Coinbase {
+			message.Prefilled = append(message.Prefilled, PrefilledTransaction{Index: uint32(idx), Transaction: transaction})
+		} else {
+			message.Short_Ids = append(message.Short_Ids, short_id(key, transaction.hashed()))
+		}
+	}
+	return message
+}
+
+// function create_partial_block places the prefilled transactions of a compact block at their leaves and the
+// transactions of the given mempool at the leaves of their short ids. a short id that matches no transaction or
+// several leaves its leaf empty
+func create_partial_block(message CompactBlockMessage, mempool *Mempool) (*PartialBlock, error) {
+	count := len(message.Short_Ids) + len(message.Prefilled)
+	if count == 0 || count > max_block_transaction_count {
+		return nil, fmt.Errorf("compact block of %d transactions", count)
+	}
+	partial := &PartialBlock{Block: message.Block, Transactions: make([]Transaction, count), Received_At: time.Now().Unix()}
+	for i, prefilled := range message.Prefilled {
+		if int(prefilled.Index) >= count || (i > 0 && prefilled.Index <= message.Prefilled[i-1].Index) {
+			return nil, errors.New("prefilled transactions are out of order")
+		}
+		partial.Transactions[prefilled.Index] = prefilled.Transaction
+	}
+
+	key := short_id_key(message.Block, message.Nonce)
+	candidates := make(map[uint64]Transaction, mempool.count())
+	ambiguous := make(map[uint64]bool)
+	for transaction_hash, entry := range mempool.Entries {
+		id := short_id(key, transaction_hash)
+		if _, ok := candidates[id]; ok {
+			ambiguous[id] = true
+		}
+		candidates[id] = entry.Transaction
+	}
+	next := 0
+	for _, id := range message.Short_Ids {
+		for partial.Transactions[next].Not_Null {
+			next++ // skip the leaves of prefilled transactions
+		}
+		if !ambiguous[id] {
+			partial.Transactions[next] = candidates[id]
+		}
+		next++
+	}
+	return partial, nil
+}
+
+// PartialBlock's method missing returns the leaf indexes of the transactions that did not arrive yet
+func (partial *PartialBlock) missing() []uint32 {
+	indexes := make([]uint32, 0)
+	for idx, transaction := range partial.Transactions {
+		if !transaction.Not_Null {
+			indexes = append(indexes, uint32(idx))
+		}
+	}
+	return indexes
+}
+
+// PartialBlock's method fill places the given transactions at the missing leaves in order, returns false if their
+// number does not match
+func (partial *PartialBlock) fill(transactions []Transaction) bool {
+	missing := partial.missing()
+	if len(missing) != len(transactions) {
+		return false
+	}
+	for i, idx := range missing {
+		partial.Transactions[idx] = transactions[i]
+	}
+	return true
+}
+
+// PartialBlock's method merkel_tree builds the merkel tree of the block from its transactions, returns false if they
+// do not make the block's merkel root, e.g. when a short id matched the wrong transaction
+func (partial *PartialBlock) merkel_tree() (MerkelTree, bool) {
+	merkel_tree := create_merkel_tree()
+	for _, transaction := range partial.Transactions {
+		if !merkel_tree.add_transaction(transaction) {
+			return merkel_tree, false
+		}
+	}
+	merkel_tree.build()
+	return merkel_tree, merkel_tree.hashed() == partial.Block.Merkel_Root
+}
+
+// Peer's method __receive_compact_block rebuilds a block from a compact block sent by a neighbour using the peer's
+// own transactions. the transactions the peer does not have are asked of the neighbour, and the whole block is asked
+// for if the compact block can not be rebuilt
+func (peer *Peer) __receive_compact_block(message CompactBlockMessage, from Address) {
+	block_hash := message.Block.hashed()
+	_, known := peer.Blockchain.Blocks[block_hash]
+	_, pending := peer.Partial_Blocks[block_hash]
+	if known || pending || message.Block.Trailing_Zeros < peer.pc.Chain_Params.Min_Trailing_Zeros || !message.Block.is_valid() {
+		return
+	}
+	partial, err := create_partial_block(message, peer.Mempool)
+	if err != nil {
+		peer.__request_full_block(block_hash, from)
+		return
+	}
+	partial.From, partial.Bytes = from, len(message.encode_wire())
+	if missing := partial.missing(); len(missing) > 0 {
+		peer.Partial_Blocks[block_hash] = partial
+		peer.Compact_Stats.Requested += uint64(len(missing))
+		peer.__send(GetBlockTransactionsMessage{Block_Hash: block_hash, Indexes: missing}, from)
+		return
+	}
+	peer.Compact_Stats.Reconstructed++
+	peer.__complete_partial_block(partial)
+}
+
+// Peer's method __receive_block_transactions fills the missing transactions of a compact block the peer is rebuilding
+func (peer *Peer) __receive_block_transactions(message BlockTransactionsMessage, from Address) {
+	partial, ok := peer.Partial_Blocks[message.Block_Hash]
+	if !ok || partial.From != from {
+		return
+	}
+	delete(peer.Partial_Blocks, message.Block_Hash)
+	partial.Bytes += len(message.encode_wire())
+	if !partial.fill(message.Transactions) {
+		peer.__request_full_block(message.Block_Hash, from)
+		return
+	}
+	peer.__complete_partial_block(partial)
+}
+
+// Peer's method __complete_partial_block builds the merkel tree of a compact block whose transactions are all in and
+// handles the block like any block a neighbour sent
+func (peer *Peer) __complete_partial_block(partial *PartialBlock) {
+	merkel_tree, ok := partial.merkel_tree()
+	if !ok {
+		peer.__request_full_block(partial.Block.hashed(), partial.From)
+		return
+	}
+	peer.Compact_Stats.Blocks++
+	peer.Compact_Stats.Compact_Bytes += uint64(partial.Bytes)
+	peer.Compact_Stats.Full_Bytes += uint64(len(NewBlockMessage{Block: partial.Block, Merkel_Tree: merkel_tree}.encode_wire()))
+	peer.__receive_block(partial.Block, merkel_tree, partial.From)
+}
+
+// Peer's method __request_full_block asks a neighbour for a block that could not be rebuilt from its compact block
+func (peer *Peer) __request_full_block(block_hash Hash, from Address) {
+	peer.Compact_Stats.Failed++
+	peer.__send(GetDataMessage{Items: []InvItem{{Type: inv_type_block, Hash: block_hash}}}, from)
+}
+
+// Peer's method __serve_block_transactions sends the transactions at the requested leaves of a block to the neighbour
+// that is rebuilding it from a compact block
+func (peer *Peer) __serve_block_transactions(message GetBlockTransactionsMessage, to Address) {
+	block, ok := peer.Blockchain.Blocks[message.Block_Hash]
+	if !ok {
+		return
+	}
+	transactions := peer.Blockchain.Merkel_Trees[block.Merkel_Root].ordered_transactions()
+	requested := make([]Transaction, 0, len(message.Indexes))
+	for _, idx := range message.Indexes {
+		if int(idx) >= len(transactions) {
+			return
+		}
+		requested = append(requested, transactions[idx])
+	}
+	peer.__send(BlockTransactionsMessage{Block_Hash: message.Block_Hash, Transactions: requested}, to)
+}
+
+// Peer's method __prune_partial_blocks drops the compact blocks whose missing transactions did not arrive in time
+func (peer *Peer) __prune_partial_blocks() {
+	now := time.Now().Unix()
+	for block_hash, partial := range peer.Partial_Blocks {
+		if now-partial.Received_At > partial_block_timeout {
+			delete(peer.Partial_Blocks, block_hash)
+		}
+	}
+}
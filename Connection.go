@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// a connection that receives nothing for this long is closed. neighbours exchange hello and hi packets well within
+// this time, so only connections that are no longer used are closed
+const connection_idle_timeout = 30 * time.Second
+
+// time allowed to dial a peer or to write a single frame to it
+const connection_io_timeout = 5 * time.Second
+
+// number of packets waiting to be written to a connection, packets sent to a connection whose queue is full are dropped
+const connection_write_queue_size = 256
+
+// connections a peer accepts at most in total and from a single ip address, further ones are closed right away
+const (
+	max_inbound_connections        = 128
+	max_inbound_connections_per_ip = 16
+)
+
+// bounds of the time a peer waits before dialing an address again after failing to connect to it
+const (
+	min_reconnect_backoff = 1 * time.Second
+	max_reconnect_backoff = 60 * time.Second
+)
+
+// function write_frame writes the given packet to w as a single frame: the length of the encoded packet as 4 big
+// endian bytes followed by the packet encoded by encode_packet
+func write_frame(w io.Writer, network_packet NetworkPacket) error {
+	body := encode_packet(network_packet)
+	_, err := w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...))
+	return err
+}
+
+// function read_frame reads a single frame written by write_frame from r. the part of the packet before its message is
+// read first and a frame longer than the longest packet of its request type is refused without reading the rest, so
+// that a peer can not make the receiver allocate more than that. likewise the header of a new block or compact block
+// is read before its transactions and the frame is refused if the header's hash does not have the trailing zeros it
+// claims or fewer than min_trailing_zeros, so that decoding a large block costs the sender proof of work. the header
+// of the returned packet is set even if the rest of the frame can not be decoded. errors about the content of the
+// frame wrap err_malformed_packet
+func read_frame(r io.Reader, min_trailing_zeros int) (NetworkPacket, error) {
+	length_prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, length_prefix); err != nil {
+		return NetworkPacket{}, err
+	}
+	length := binary.BigEndian.Uint32(length_prefix)
+	if length < packet_prefix_size {
+		return NetworkPacket{}, fmt.Errorf("%w: frame of %d bytes is too short", err_malformed_packet, length)
+	}
+	body := make([]byte, packet_prefix_size, min(int(length), packet_prefix_size+4096))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return NetworkPacket{}, err
+	}
+	network_packet, req_type, _ := decode_packet_prefix(body)
+	if limit, ok := max_packet_size(req_type); !ok || int(length) > limit {
+		return network_packet, fmt.Errorf("%w: frame of %d bytes is too long for request type %d", err_malformed_packet, length, req_type)
+	}
+	read := packet_prefix_size
+	if (req_type == req_type_new_block || req_type == req_type_compact_block) && int(length) >= packet_prefix_size+block_header_size {
+		body = append(body, make([]byte, block_header_size)...)
+		if _, err := io.ReadFull(r, body[read:]); err != nil {
+			return network_packet, err
+		}
+		read += block_header_size
+		reader := WireReader{Data: body[packet_prefix_size:]}
+		block := reader.read_block_header()
+		if block.Trailing_Zeros < min_trailing_zeros || block.hashed().trailing_zeros() < block.Trailing_Zeros {
+			return network_packet, fmt.Errorf("%w: block %s lacks the proof of work of %d trailing zeros", err_malformed_packet, block.hashed().to_string(), max(block.Trailing_Zeros, min_trailing_zeros))
+		}
+	}
+	body = append(body, make([]byte, int(length)-read)...)
+	if _, err := io.ReadFull(r, body[read:]); err != nil {
+		return network_packet, err
+	}
+	return decode_packet(body)
+}
+
+// Type Connection holds a long lived connection to another peer. packets queued on it are written by its write loop
+// and the packets received on it are read by its read loop, both ways use the same tcp connection
+type Connection struct {
+	Remote      Address // listening address of the other peer, zero for an accepted connection until it is bound
+	Write_Queue chan NetworkPacket
+	conn        net.Conn
+	inbound_ip  string // ip address an accepted connection comes from, empty for a dialed one
+	done        chan struct{}
+	close_once  sync.Once
+}
+
+// Type ReconnectBackoff holds how long a peer waits before dialing an address that it failed to connect to
+type ReconnectBackoff struct {
+	Failures int       // dials that failed in a row
+	Retry_At time.Time // packets sent to the address before this time are dropped instead of dialing again
+}
+
+// Type ConnectionPool holds the connections of a peer, at most one used for sending to each address. packets
+// received on any connection whose header matches the peer's header are written to Up_Channel
+type ConnectionPool struct {
+	Self               Address
+	Header             PacketHeader    // stamped on every packet sent and required of every packet received
+	Dropped            *PacketCounters // packets dropped for a header that does not match Header or for being malformed
+	Min_Trailing_Zeros int             // trailing zeros a block received in full or compact form has to have at least
+	Up_Channel         chan<- NetworkPacket
+	Connections        map[Address]*Connection
+	Backoff            map[Address]ReconnectBackoff
+	Inbound            map[string]int // {remote ip: accepted connections from it that are open}
+	Inbound_Total      int            // accepted connections that are open
+	listener           net.Listener
+	mutex              sync.Mutex // guards Connections, Backoff, Inbound, Inbound_Total and the Remote and conn of every connection
+}
+
+// function create_connection_pool returns an empty connection pool for the peer listening on the given address
+func create_connection_pool(self Address, header PacketHeader, dropped *PacketCounters, up_channel chan<- NetworkPacket) *ConnectionPool {
+	return &ConnectionPool{Self: self, Header: header, Dropped: dropped, Up_Channel: up_channel, Connections: make(map[Address]*Connection), Backoff: make(map[Address]ReconnectBackoff), Inbound: make(map[string]int)}
+}
+
+// ConnectionPool's method listen starts accepting connections on the pool's address in the background. connections
+// from an ip address banned for sending malformed packets, or beyond max_inbound_connections in total or
+// max_inbound_connections_per_ip from one ip address, are closed right away
+func (pool *ConnectionPool) listen() error {
+	ln, err := net.Listen("tcp", pool.Self.to_string())
+	if err != nil {
+		return err
+	}
+	pool.listener = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // the listener was closed
+			}
+			ip := remote_ip(conn)
+			if pool.Dropped.is_banned(ip) {
+				conn.Close() // the address sent too many malformed packets lately
+				continue
+			}
+			pool.mutex.Lock()
+			accept := pool.Inbound_Total < max_inbound_connections && pool.Inbound[ip] < max_inbound_connections_per_ip
+			if accept {
+				pool.Inbound_Total++
+				pool.Inbound[ip]++
+			}
+			pool.mutex.Unlock()
+			if !accept {
+				conn.Close()
+				continue
+			}
+			pool.__start(&Connection{Write_Queue: make(chan NetworkPacket, connection_write_queue_size), conn: conn, inbound_ip: ip, done: make(chan struct{})})
+		}
+	}()
+	return nil
+}
+
+// ConnectionPool's method send stamps the pool's header on the given packet and queues it on the connection to the
+// target, dialing the target in the background if there is no connection yet. the packet is dropped if the target
+// can not be dialed again yet or its write queue is full
+func (pool *ConnectionPool) send(network_packet NetworkPacket, target Address) {
+	network_packet.Header = pool.Header
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	connection, ok := pool.Connections[target]
+	if !ok {
+		if time.Now().Before(pool.Backoff[target].Retry_At) {
+			return
+		}
+		connection = &Connection{Remote: target, Write_Queue: make(chan NetworkPacket, connection_write_queue_size), done: make(chan struct{})}
+		pool.Connections[target] = connection
+		go pool.__dial(connection)
+	}
+	select {
+	case connection.Write_Queue <- network_packet:
+	default:
+	}
+}
+
+// ConnectionPool's method reply queues a packet holding the given message on the connection the request was received
+// on, so that a client that does not listen for connections gets the answer. the packet is dropped if the connection
+// is closed or its write queue is full
+func (pool *ConnectionPool) reply(request NetworkPacket, message Message) {
+	if request.connection == nil {
+		return
+	}
+	select {
+	case request.connection.Write_Queue <- NetworkPacket{Header: pool.Header, Req_From: pool.Self, Message: message}:
+	case <-request.connection.done:
+	default:
+	}
+}
+
+// ConnectionPool's method bind returns true if the given packet came in on a connection to its sender: a connection
+// the peer dialed to the sender's address, or an accepted connection bound to the sender. an accepted connection that
+// is not bound yet is bound to the sender only if it comes from the sender's ip address, and is then used for sending
+// to the sender unless there already is a connection to it. the peer binds connections only for senders that
+// completed a handshake, so that a packet merely claiming an address can neither take over the sending to it nor pass
+// for a neighbour's
+func (pool *ConnectionPool) bind(network_packet NetworkPacket) bool {
+	connection := network_packet.connection
+	if connection == nil || network_packet.Req_From == (Address{}) {
+		return false
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if connection.Remote != (Address{}) {
+		return connection.Remote == network_packet.Req_From
+	}
+	if connection.inbound_ip == "" || !network_packet.Req_From.has_ip(connection.inbound_ip) {
+		return false
+	}
+	select {
+	case <-connection.done:
+		return false
+	default:
+	}
+	connection.Remote = network_packet.Req_From
+	if _, ok := pool.Connections[connection.Remote]; !ok {
+		pool.Connections[connection.Remote] = connection
+	}
+	return true
+}
+
+// ConnectionPool's method disconnect closes the connection to the given address if there is one
+func (pool *ConnectionPool) disconnect(target Address) {
+	pool.mutex.Lock()
+	connection, ok := pool.Connections[target]
+	pool.mutex.Unlock()
+	if ok {
+		pool.__close(connection)
+	}
+}
+
+// ConnectionPool's method close stops accepting connections and closes every connection of the pool
+func (pool *ConnectionPool) close() {
+	if pool.listener != nil {
+		pool.listener.Close()
+	}
+	pool.mutex.Lock()
+	connections := get_map_values(pool.Connections)
+	pool.mutex.Unlock()
+	for _, connection := range connections {
+		pool.__close(connection)
+	}
+}
+
+// ConnectionPool's method __dial connects to the remote address of the given connection. the time until the address
+// is dialed again doubles with every failed dial, starting from min_reconnect_backoff up to max_reconnect_backoff
+func (pool *ConnectionPool) __dial(connection *Connection) {
+	conn, err := net.DialTimeout("tcp", connection.Remote.to_string(), connection_io_timeout)
+	if err != nil {
+		fmt.Printf("Network Dial from %d to %d failed: %v\n", pool.Self.Port, connection.Remote.Port, err)
+		pool.mutex.Lock()
+		backoff := pool.Backoff[connection.Remote]
+		backoff.Failures++
+		backoff.Retry_At = time.Now().Add(min(min_reconnect_backoff<<min(backoff.Failures-1, 16), max_reconnect_backoff))
+		pool.Backoff[connection.Remote] = backoff
+		pool.mutex.Unlock()
+		pool.__close(connection)
+		return
+	}
+	pool.mutex.Lock()
+	delete(pool.Backoff, connection.Remote)
+	connection.conn = conn
+	select {
+	case <-connection.done:
+		conn.Close() // the connection was closed while dialing
+	default:
+		pool.__start(connection)
+	}
+	pool.mutex.Unlock()
+}
+
+// ConnectionPool's method __start runs the read and write loops of a connected connection
+func (pool *ConnectionPool) __start(connection *Connection) {
+	go pool.__write_loop(connection)
+	go pool.__read_loop(connection)
+}
+
+// ConnectionPool's method __write_loop writes the packets queued on the connection until it is closed
+func (pool *ConnectionPool) __write_loop(connection *Connection) {
+	for {
+		select {
+		case network_packet := <-connection.Write_Queue:
+			connection.conn.SetWriteDeadline(time.Now().Add(connection_io_timeout))
+			if err := write_frame(connection.conn, network_packet); err != nil {
+				pool.__close(connection)
+				return
+			}
+		case <-connection.done:
+			return
+		}
+	}
+}
+
+// ConnectionPool's method __read_loop reads packets from the connection until it is closed or stays idle for too
+// long. each packet passed on remembers the connection, so that the peer can reply on it or bind it
+func (pool *ConnectionPool) __read_loop(connection *Connection) {
+	for {
+		connection.conn.SetReadDeadline(time.Now().Add(connection_idle_timeout))
+		network_packet, err := read_frame(connection.conn, pool.Min_Trailing_Zeros)
+		if err != nil && !errors.Is(err, err_malformed_packet) {
+			pool.__close(connection) // closed by the other peer or idle for too long
+			return
+		}
+		if !pool.Dropped.count(network_packet.Header, pool.Header) {
+			if err != nil {
+				pool.__close(connection) // a packet of another network that this peer can not even skip
+				return
+			}
+			continue
+		}
+		if err != nil {
+			// the rest of the stream can not be trusted after a malformed packet
+			pool.Dropped.count_malformed(remote_ip(connection.conn))
+			pool.__close(connection)
+			return
+		}
+		network_packet.connection = connection
+		select {
+		case pool.Up_Channel <- network_packet:
+		case <-connection.done:
+			return
+		}
+	}
+}
+
+// function remote_ip returns the ip address the given connection comes from, without its port, which changes with
+// every connection
+func remote_ip(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// ConnectionPool's method __close closes the connection and removes it from the pool so that the next packet sent to
+// its address dials it again
+func (pool *ConnectionPool) __close(connection *Connection) {
+	connection.close_once.Do(func() {
+		close(connection.done)
+		pool.mutex.Lock()
+		if connection.conn != nil {
+			connection.conn.Close()
+		}
+		if pool.Connections[connection.Remote] == connection {
+			delete(pool.Connections, connection.Remote)
+		}
+		if connection.inbound_ip != "" {
+			pool.Inbound_Total--
+			if pool.Inbound[connection.inbound_ip]--; pool.Inbound[connection.inbound_ip] <= 0 {
+				delete(pool.Inbound, connection.inbound_ip)
+			}
+		}
+		pool.mutex.Unlock()
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// timestamp of the genisys node of networks that do not give one
+const default_genesis_timestamp = 1704067200
+
+// Type GenesisConfig holds the definition of the genisys node of a network. it is read from a json file so that
+// every peer of the network starts from the same block
+type GenesisConfig struct {
+	Network_Id     string            // name of the network, part of the genisys node so that networks are told apart
+	Timestamp      int64             // unix time of the genisys node
+	Trailing_Zeros int               // trailing zero bits required of the blocks until the first retarget
+	Allocations    map[string]uint64 // {account: balance} before the first block
+}
+
+// function load_genesis_config reads a genesis config from the given json file
+func load_genesis_config(filename string) (GenesisConfig, error) {
+	config := GenesisConfig{}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, err
+	}
+	if config.Trailing_Zeros < 0 || config.Timestamp <= 0 {
+		return config, fmt.Errorf("genesis config has an invalid timestamp or difficulty")
+	}
+	for address := range config.Allocations {
+		if !is_valid_address(address) {
+			return config, fmt.Errorf("genesis config allocates to invalid address %q", address)
+		}
+	}
+	return config, nil
+}
+
+// function genesis_block returns the genisys node defined by the chain parameters along with its merkel tree. the
+// merkel tree holds a single coinbase naming the network and listing the initial balances, which is not applied to
+// the ledger since the ledger starts with the initial balances. the genisys node is never mined, every peer creates it
+func genesis_block(params ChainParams) (Block, MerkelTree) {
+	addresses := make([]string, 0, len(params.Initial_Balances))
+	for address := range params.Initial_Balances {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	allocations := make([]TxOutput, 0, len(addresses))
+	for _, address := range addresses {
+		allocations = append(allocations, TxOutput{Owner: address, Amount: params.Initial_Balances[address]})
+	}
+
+	merkel_tree := create_merkel_tree()
+	merkel_tree.add_transaction(Transaction{Memo: params.Network_Id, Outputs: allocations, Is_Coinbase: true, Not_Null: true})
+	merkel_tree.build()
+	return create_block(merkel_tree.hashed(), Hash{}, 1, params.Genesis_Timestamp, params.Initial_Trailing_Zeros), merkel_tree
+}
+
+// ChainParams's method chain_id returns the hash of the genisys node, which tells the chain apart from the chains of
+// other networks
+func (params ChainParams) chain_id() Hash {
+	genesis, _ := genesis_block(params)
+	return genesis.hashed()
+}
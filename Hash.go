@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 )
 
 // Type Hash holds a hash
@@ -19,6 +21,22 @@ func (hash Hash) to_string() string {
 	return hex.EncodeToString(hash.Value[:])
 }
 
+// Hash's method less orders hashes by their bytes
+func (hash Hash) less(other Hash) bool {
+	return bytes.Compare(hash.Value[:], other.Value[:]) < 0
+}
+
+// function parse_hash converts a hexadecimal string written by to_string back to a hash
+func parse_hash(value string) (Hash, error) {
+	hash := Hash{}
+	raw, err := hex.DecodeString(value)
+	if err != nil || len(raw) != len(hash.Value) {
+		return hash, fmt.Errorf("%q is not a hex encoded hash", value)
+	}
+	copy(hash.Value[:], raw)
+	return hash, nil
+}
+
 func (hash Hash) trailing_zeros() int {
 	count := 0
 	for i := 31; i >= 0; i-- {
@@ -0,0 +1,153 @@
+package main
+
+import "time"
+
+// kinds of items announced in an inventory
+const (
+	inv_type_transaction   = iota
+	inv_type_block         = iota
+	inv_type_compact_block = iota // only asked for, a block announced to a neighbour that relays compact blocks
+)
+
+// items remembered per neighbour as known to it, the oldest are forgotten first
+const max_known_inventory = 10000
+
+// seconds an item asked of a neighbour is not asked of another neighbour that announces it
+const inventory_request_timeout = 10
+
+// Type InvItem names a transaction or block by its kind and hash
+type InvItem struct {
+	Type int
+	Hash Hash
+}
+
+// Type KnownInventory holds the hashes of the items a neighbour is known to have, either because it sent or announced
+// them or because they were sent or announced to it
+type KnownInventory struct {
+	Items map[Hash]bool
+	Order []Hash // hashes of Items from the oldest to the newest
+}
+
+func create_known_inventory() *KnownInventory {
+	return &KnownInventory{Items: make(map[Hash]bool), Order: make([]Hash, 0)}
+}
+
+// KnownInventory's method add remembers the given hash, forgetting the oldest one if max_known_inventory are kept
+func (known *KnownInventory) add(hash Hash) {
+	if known.Items[hash] {
+		return
+	}
+	known.Items[hash] = true
+	known.Order = append(known.Order, hash)
+	if len(known.Order) > max_known_inventory {
+		delete(known.Items, known.Order[0])
+		known.Order = known.Order[1:]
+	}
+}
+
+func (known *KnownInventory) has(hash Hash) bool {
+	return known.Items[hash]
+}
+
+// Peer's method __known_inventory returns the items the given neighbour is known to have
+func (peer *Peer) __known_inventory(neighbour Address) *KnownInventory {
+	known, ok := peer.Known_Inventory[neighbour]
+	if !ok {
+		known = create_known_inventory()
+		peer.Known_Inventory[neighbour] = known
+	}
+	return known
+}
+
+// Peer's method __announce announces the given item to every neighbour that is not known to have it. neighbours that
+// do not take inventories are sent the given message holding the whole item instead
+func (peer *Peer) __announce(item InvItem, message Message) {
+	for neighbour := range peer.Neighbours {
+		known := peer.__known_inventory(neighbour)
+		if known.has(item.Hash) {
+			continue
+		}
+		known.add(item.Hash)
+		if peer.Neighbour_Handshakes[neighbour].has_feature(feature_inventory) {
+			peer.__send(InvMessage{Items: []InvItem{item}}, neighbour)
+		} else {
+			peer.__send(message, neighbour)
+		}
+	}
+}
+
+// Peer's method __has_item returns true if the peer already has the given item
+func (peer *Peer) __has_item(item InvItem) bool {
+	switch item.Type {
+	case inv_type_transaction:
+		return peer.Mempool.has(item.Hash)
+	case inv_type_block:
+		_, ok := peer.Blockchain.Blocks[item.Hash]
+		_, pending := peer.Partial_Blocks[item.Hash]
+		return ok || pending || peer.Grouped_Blocks[item.Hash]
+	}
+	return true
+}
+
+// Peer's method __receive_inventory asks the neighbour that announced the given items for those the peer lacks,
+// unless they were asked of another neighbour less than inventory_request_timeout seconds ago. blocks are asked for
+// as compact blocks if the neighbour relays them
+func (peer *Peer) __receive_inventory(items []InvItem, from Address) {
+	known, now := peer.__known_inventory(from), time.Now().Unix()
+	wanted := make([]InvItem, 0, len(items))
+	for _, item := range items {
+		known.add(item.Hash)
+		if item.Type == inv_type_compact_block || peer.__has_item(item) || now-peer.Inventory_Requests[item.Hash] < inventory_request_timeout {
+			continue
+		}
+		peer.Inventory_Requests[item.Hash] = now
+		if item.Type == inv_type_block && peer.Neighbour_Handshakes[from].has_feature(feature_compact_blocks) {
+			item.Type = inv_type_compact_block
+		}
+		wanted = append(wanted, item)
+	}
+	if len(wanted) > 0 {
+		peer.__send(GetDataMessage{Items: wanted}, from)
+	}
+}
+
+// Peer's method __serve_data sends the requested items the peer has to the neighbour that asked for them
+func (peer *Peer) __serve_data(items []InvItem, to Address) {
+	known := peer.__known_inventory(to)
+	for _, item := range items {
+		switch item.Type {
+		case inv_type_transaction:
+			if transaction, ok := peer.Mempool.get(item.Hash); ok {
+				peer.__send(NewTransactionMessage{Transaction: transaction}, to)
+				known.add(item.Hash)
+			}
+		case inv_type_block:
+			if block, ok := peer.Blockchain.Blocks[item.Hash]; ok {
+				peer.__send(NewBlockMessage{Block: block, Merkel_Tree: peer.Blockchain.Merkel_Trees[block.Merkel_Root]}, to)
+				known.add(item.Hash)
+			}
+		case inv_type_compact_block:
+			if block, ok := peer.Blockchain.Blocks[item.Hash]; ok {
+				peer.__send(create_compact_block(block, peer.Blockchain.Merkel_Trees[block.Merkel_Root]), to)
+				known.add(item.Hash)
+			}
+		}
+	}
+}
+
+// Peer's method __received_item records that the given neighbour sent the item with the given hash, so that it is
+// neither announced back to it nor asked of anyone anymore
+func (peer *Peer) __received_item(hash Hash, from Address) {
+	peer.__known_inventory(from).add(hash)
+	delete(peer.Inventory_Requests, hash)
+}
+
+// Peer's method __prune_inventory_requests forgets the requests that timed out, the items may be asked for again
+func (peer *Peer) __prune_inventory_requests() {
+	now := time.Now().Unix()
+	for hash, requested_at := range peer.Inventory_Requests {
+		if now-requested_at >= inventory_request_timeout {
+			delete(peer.Inventory_Requests, hash)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// function generate_key returns a new random ed25519 private key
+func generate_key() ed25519.PrivateKey {
+	_, private_key, _ := ed25519.GenerateKey(rand.Reader)
+	return private_key
+}
+
+// function key_from_seed returns the private key for the given hex encoded 32 byte seed
+func key_from_seed(seed string) (ed25519.PrivateKey, error) {
+	raw, err := hex.DecodeString(seed)
+	if err != nil || len(raw) != ed25519.SeedSize {
+		return nil, fmt.Errorf("key seed should be %d hex encoded bytes", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(raw), nil
+}
+
+// function key_seed returns the hex encoded seed of a private key, which is enough to restore the key
+func key_seed(private_key ed25519.PrivateKey) string {
+	return hex.EncodeToString(private_key.Seed())
+}
+
+// version byte at the start of every address
+const address_version = byte(0)
+
+// alphabet used by base58, which leaves out the characters that are easily confused (0, O, I and l)
+const base58_alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// function address_from_public_key returns the account address owned by the given public key. the address is the
+// base58 encoding of a version byte, the first 20 bytes of the key's sha256 hash and a 4 byte checksum
+func address_from_public_key(public_key ed25519.PublicKey) string {
+	digest := sha256.Sum256(public_key)
+	payload := append([]byte{address_version}, digest[:20]...)
+	return base58_encode(append(payload, address_checksum(payload)...))
+}
+
+// function is_valid_address checks whether the given string is a well formed address with a correct checksum
+func is_valid_address(address string) bool {
+	raw, ok := base58_decode(address)
+	if !ok || len(raw) != 25 || raw[0] != address_version {
+		return false
+	}
+	return bytes.Equal(address_checksum(raw[:21]), raw[21:])
+}
+
+// function address_checksum returns the first 4 bytes of the double sha256 hash of the payload
+func address_checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// function base58_encode encodes the given bytes using base58_alphabet. leading zero bytes become leading '1's
+func base58_encode(raw []byte) string {
+	num := new(big.Int).SetBytes(raw)
+	base, mod := big.NewInt(58), new(big.Int)
+	out := make([]byte, 0, len(raw)*138/100+1)
+	for num.Sign() > 0 {
+		num.DivMod(num, base, mod)
+		out = append(out, base58_alphabet[mod.Int64()])
+	}
+	for _, b := range raw {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58_alphabet[0])
+	}
+	return string(reverse_slice(out))
+}
+
+// function base58_decode reverses base58_encode. returns false if value holds a character outside the alphabet
+func base58_decode(value string) ([]byte, bool) {
+	num, base := new(big.Int), big.NewInt(58)
+	leading_zeros := 0
+	for i := 0; i < len(value) && value[i] == base58_alphabet[0]; i++ {
+		leading_zeros++
+	}
+	for i := 0; i < len(value); i++ {
+		digit := strings.IndexByte(base58_alphabet, value[i])
+		if digit == -1 {
+			return nil, false
+		}
+		num.Mul(num, base)
+		num.Add(num, big.NewInt(int64(digit)))
+	}
+	return append(make([]byte, leading_zeros), num.Bytes()...), true
+}
+
+// function address_from_key returns the account address owned by the given private key
+func address_from_key(private_key ed25519.PrivateKey) string {
+	return address_from_public_key(private_key.Public().(ed25519.PublicKey))
+}
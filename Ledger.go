@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Type Account holds the state of a single account
+type Account struct {
+	Balance uint64
+	Nonce   uint64 // nonce the next transaction sent from this account must carry
+}
+
+// Type UtxoEntry holds an unspent output along with the height of the block that created it
+type UtxoEntry struct {
+	Output      TxOutput
+	Height      uint64
+	Is_Coinbase bool
+}
+
+// Type LedgerUndo holds what is needed to disconnect a block from the ledger
+type LedgerUndo struct {
+	Height          uint64                 // height of the block
+	Accounts        map[string]Account     // account mode: {account: state before the block}
+	Spent_Outputs   map[OutPoint]UtxoEntry // utxo mode: outputs the block spent
+	Created_Outputs []OutPoint             // utxo mode: outputs the block created
+	Released        map[string]uint64      // account mode: coinbase rewards that matured at the block
+	Rewarded        string                 // account mode: receiver of the block's coinbase if it was not mature yet
+	Reward          uint64
+}
+
+// Type Ledger holds the state after applying the transactions of a chain of blocks. depending on the
+// ledger mode either the accounts or the unspent outputs are used
+type Ledger struct {
+	Mode              int
+	Block_Reward      uint64
+	Coinbase_Maturity uint64
+	Height            uint64 // height of the last block connected to the ledger, the genisys node's height to start with
+	Accounts          map[string]Account
+	Immature          map[uint64]map[string]uint64 // account mode: {height: {account: reward}} coinbase rewards credited at height
+	Utxos             map[OutPoint]UtxoEntry
+	Undo              map[Hash]LedgerUndo // {block hash: undo data} for every connected block that may still be disconnected
+}
+
+// function create_ledger returns the ledger right after the genisys node of the given chain parameters, holding only
+// their initial balances
+func create_ledger(params ChainParams) Ledger {
+	ledger := Ledger{Height: 1, Mode: params.Ledger_Mode, Block_Reward: params.Block_Reward, Coinbase_Maturity: params.Coinbase_Maturity, Accounts: make(map[string]Account), Immature: make(map[uint64]map[string]uint64), Utxos: make(map[OutPoint]UtxoEntry), Undo: make(map[Hash]LedgerUndo)}
+	for address, balance := range params.Initial_Balances {
+		if ledger.Mode == ledger_mode_utxo {
+			ledger.Utxos[allocation_out_point(address)] = UtxoEntry{Output: TxOutput{Owner: address, Amount: balance}}
+		} else {
+			ledger.Accounts[address] = Account{Balance: balance}
+		}
+	}
+	return ledger
+}
+
+// function allocation_out_point returns the out point under which the initial balance of an account is
+// stored in the utxo ledger mode
+func allocation_out_point(address string) OutPoint {
+	return OutPoint{Transaction: hash_string("initial balance of " + address)}
+}
+
+func (ledger Ledger) copy() Ledger {
+	out := Ledger{Mode: ledger.Mode, Block_Reward: ledger.Block_Reward, Coinbase_Maturity: ledger.Coinbase_Maturity, Height: ledger.Height, Accounts: make(map[string]Account, len(ledger.Accounts)), Immature: make(map[uint64]map[string]uint64, len(ledger.Immature)), Utxos: make(map[OutPoint]UtxoEntry, len(ledger.Utxos)), Undo: make(map[Hash]LedgerUndo, len(ledger.Undo))}
+	for address, account := range ledger.Accounts {
+		out.Accounts[address] = account
+	}
+	for height, rewards := range ledger.Immature {
+		out.Immature[height] = make(map[string]uint64, len(rewards))
+		for address, reward := range rewards {
+			out.Immature[height][address] = reward
+		}
+	}
+	for out_point, entry := range ledger.Utxos {
+		out.Utxos[out_point] = entry
+	}
+	for block_hash, undo := range ledger.Undo {
+		out.Undo[block_hash] = undo
+	}
+	return out
+}
+
+// Ledger's method get_account returns the state of an account. accounts that never received anything are empty
+func (ledger Ledger) get_account(address string) Account {
+	return ledger.Accounts[address]
+}
+
+// Ledger's method get_balance returns the spendable balance of an address in either ledger mode
+func (ledger Ledger) get_balance(address string) uint64 {
+	if ledger.Mode != ledger_mode_utxo {
+		return ledger.get_account(address).Balance
+	}
+	balance := uint64(0)
+	for _, entry := range ledger.Utxos {
+		if entry.Output.Owner == address && ledger.__is_mature(entry) {
+			balance += entry.Output.Amount
+		}
+	}
+	return balance
+}
+
+// Ledger's method get_immature_balance returns the coinbase rewards of an address that can not be spent yet
+func (ledger Ledger) get_immature_balance(address string) uint64 {
+	balance := uint64(0)
+	for _, rewards := range ledger.Immature {
+		balance += rewards[address]
+	}
+	for _, entry := range ledger.Utxos {
+		if entry.Output.Owner == address && !ledger.__is_mature(entry) {
+			balance += entry.Output.Amount
+		}
+	}
+	return balance
+}
+
+// Ledger's method __is_mature checks whether an unspent output can be spent by the next block
+func (ledger Ledger) __is_mature(entry UtxoEntry) bool {
+	return !entry.Is_Coinbase || ledger.Height+1-entry.Height >= ledger.Coinbase_Maturity
+}
+
+// Ledger's method known_addresses returns every address that holds an account or an unspent output, sorted
+func (ledger Ledger) known_addresses() []string {
+	known := make(map[string]bool)
+	for address := range ledger.Accounts {
+		known[address] = true
+	}
+	for _, entry := range ledger.Utxos {
+		known[entry.Output.Owner] = true
+	}
+	addresses := get_map_keys(known)
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Ledger's method get_utxos returns the spendable unspent outputs owned by an address sorted by out point
+func (ledger Ledger) get_utxos(address string) []OutPoint {
+	out_points := make([]OutPoint, 0)
+	for out_point, entry := range ledger.Utxos {
+		if entry.Output.Owner == address && ledger.__is_mature(entry) {
+			out_points = append(out_points, out_point)
+		}
+	}
+	sort.Slice(out_points, func(i, j int) bool {
+		return out_points[i].less(out_points[j])
+	})
+	return out_points
+}
+
+// Ledger's method apply_transaction applies a single transaction. if undo is not nil, the state replaced by
+// the transaction is recorded in it. the ledger is not changed if an error is returned
+func (ledger *Ledger) apply_transaction(transaction Transaction, undo *LedgerUndo) error {
+	if transaction.Is_Coinbase {
+		return fmt.Errorf("a coinbase can only be applied by connecting its block")
+	}
+	if !transaction.Not_Null || transaction.From == "" {
+		return fmt.Errorf("transaction has no sender")
+	}
+	if ledger.Mode == ledger_mode_utxo {
+		return ledger.__apply_utxo_transaction(transaction, undo)
+	}
+	return ledger.__apply_account_transaction(transaction, undo)
+}
+
+// Ledger's method __apply_account_transaction moves the transaction's amount from its sender to its receiver. the fee is
+// taken from the sender and burned. overdrafts and nonces other than the sender's next nonce are rejected
+func (ledger *Ledger) __apply_account_transaction(transaction Transaction, undo *LedgerUndo) error {
+	if transaction.To == "" || transaction.is_utxo() {
+		return fmt.Errorf("transaction is not an account transaction")
+	}
+	if !is_valid_address(transaction.To) {
+		return fmt.Errorf("receiver %q is not a valid address", transaction.To)
+	}
+	sender := ledger.get_account(transaction.From)
+	if transaction.Nonce != sender.Nonce {
+		return fmt.Errorf("%s expected nonce %d but got %d", transaction.From, sender.Nonce, transaction.Nonce)
+	}
+	total := transaction.Amount + transaction.Fee
+	if total < transaction.Amount || sender.Balance < total {
+		return fmt.Errorf("%s can not pay %d with balance %d", transaction.From, total, sender.Balance)
+	}
+	if receiver := ledger.get_account(transaction.To); receiver.Balance+transaction.Amount < receiver.Balance {
+		return fmt.Errorf("balance of %s overflows", transaction.To)
+	}
+	ledger.__record_account(transaction.From, undo)
+	ledger.__record_account(transaction.To, undo)
+
+	sender.Balance -= total
+	sender.Nonce++
+	ledger.Accounts[transaction.From] = sender
+
+	receiver := ledger.get_account(transaction.To)
+	receiver.Balance += transaction.Amount
+	ledger.Accounts[transaction.To] = receiver
+	return nil
+}
+
+// Ledger's method __record_account saves the state of an account in undo unless it was already saved by an
+// earlier transaction of the same block
+func (ledger *Ledger) __record_account(address string, undo *LedgerUndo) {
+	if undo == nil {
+		return
+	}
+	if _, ok := undo.Accounts[address]; !ok {
+		undo.Accounts[address] = ledger.get_account(address)
+	}
+}
+
+// Ledger's method __apply_utxo_transaction spends the transaction's inputs and creates its outputs. inputs must be
+// unspent, owned by the sender and created in an earlier block. the inputs must add up to the outputs plus the fee
+func (ledger *Ledger) __apply_utxo_transaction(transaction Transaction, undo *LedgerUndo) error {
+	if transaction.To != "" || transaction.Amount != 0 || transaction.Nonce != 0 || len(transaction.Inputs) == 0 || len(transaction.Outputs) == 0 {
+		return fmt.Errorf("transaction is not a utxo transaction")
+	}
+	total_in := uint64(0)
+	seen := make(map[OutPoint]bool, len(transaction.Inputs))
+	for _, input := range transaction.Inputs {
+		entry, ok := ledger.Utxos[input]
+		if !ok || seen[input] {
+			return fmt.Errorf("output %s is spent or does not exist", input.to_string())
+		}
+		if entry.Height > ledger.Height {
+			return fmt.Errorf("output %s is created in the same block", input.to_string())
+		}
+		if entry.Output.Owner != transaction.From {
+			return fmt.Errorf("output %s is not owned by %s", input.to_string(), transaction.From)
+		}
+		if !ledger.__is_mature(entry) {
+			return fmt.Errorf("coinbase output %s is not mature", input.to_string())
+		}
+		seen[input] = true
+		total_in += entry.Output.Amount
+		if total_in < entry.Output.Amount {
+			return fmt.Errorf("inputs overflow")
+		}
+	}
+	total_out := transaction.Fee
+	for _, output := range transaction.Outputs {
+		if output.Owner == "" || output.Amount == 0 {
+			return fmt.Errorf("output has no owner or amount")
+		}
+		if !is_valid_address(output.Owner) {
+			return fmt.Errorf("owner %q is not a valid address", output.Owner)
+		}
+		total_out += output.Amount
+		if total_out < output.Amount {
+			return fmt.Errorf("outputs overflow")
+		}
+	}
+	if total_in != total_out {
+		return fmt.Errorf("inputs of %d do not match outputs plus fee of %d", total_in, total_out)
+	}
+
+	for _, input := range transaction.Inputs {
+		if undo != nil {
+			undo.Spent_Outputs[input] = ledger.Utxos[input]
+		}
+		delete(ledger.Utxos, input)
+	}
+	transaction_hash := transaction.hashed()
+	for idx, output := range transaction.Outputs {
+		out_point := OutPoint{Transaction: transaction_hash, Index: uint32(idx)}
+		ledger.Utxos[out_point] = UtxoEntry{Output: output, Height: ledger.Height + 1}
+		if undo != nil {
+			undo.Created_Outputs = append(undo.Created_Outputs, out_point)
+		}
+	}
+	return nil
+}
+
+// Ledger's method connect_block applies all the transactions of a block's merkel tree in the order of its leaves and
+// saves the undo data of the block. the first leaf must be the block's only coinbase and it must pay exactly the block
+// reward plus the fees of the other transactions. the ledger is left unchanged if an error is returned
+func (ledger *Ledger) connect_block(block_hash Hash, merkel_tree MerkelTree) error {
+	height := ledger.Height + 1
+	undo := LedgerUndo{Height: height, Accounts: make(map[string]Account), Spent_Outputs: make(map[OutPoint]UtxoEntry)}
+
+	// rewards of earlier coinbases that mature at this block become spendable before its transactions are applied
+	if released, ok := ledger.Immature[height]; ok {
+		for address, reward := range released {
+			ledger.__record_account(address, &undo)
+			account := ledger.get_account(address)
+			account.Balance += reward
+			ledger.Accounts[address] = account
+		}
+		undo.Released = released
+		delete(ledger.Immature, height)
+	}
+
+	transactions := merkel_tree.ordered_transactions()
+	if len(transactions) == 0 || !transactions[0].Is_Coinbase {
+		ledger.__revert(undo)
+		return fmt.Errorf("block has no coinbase")
+	}
+	fees := uint64(0)
+	for _, transaction := range transactions[1:] {
+		if err := ledger.apply_transaction(transaction, &undo); err != nil {
+			ledger.__revert(undo)
+			return err
+		}
+		fees += transaction.Fee
+	}
+	if err := ledger.__apply_coinbase(transactions[0], ledger.Block_Reward+fees, &undo); err != nil {
+		ledger.__revert(undo)
+		return err
+	}
+	ledger.Undo[block_hash] = undo
+	ledger.Height = height
+	return nil
+}
+
+// Ledger's method __apply_coinbase pays the coinbase's amount, which must equal expected, to the miner. in the account
+// mode the amount is credited once the coinbase is mature, in the utxo mode an output that matures later is created
+func (ledger *Ledger) __apply_coinbase(coinbase Transaction, expected uint64, undo *LedgerUndo) error {
+	height := ledger.Height + 1
+	if coinbase.From != "" || coinbase.Nonce != 0 || len(coinbase.Inputs) != 0 {
+		return fmt.Errorf("coinbase should not have a sender")
+	}
+	if ledger.Mode == ledger_mode_utxo {
+		if coinbase.To != "" || coinbase.Amount != 0 || len(coinbase.Outputs) != 1 || !is_valid_address(coinbase.Outputs[0].Owner) {
+			return fmt.Errorf("coinbase should have a single output to a valid address")
+		}
+		if coinbase.Outputs[0].Amount != expected {
+			return fmt.Errorf("coinbase pays %d instead of %d", coinbase.Outputs[0].Amount, expected)
+		}
+		out_point := OutPoint{Transaction: coinbase.hashed()}
+		ledger.Utxos[out_point] = UtxoEntry{Output: coinbase.Outputs[0], Height: height, Is_Coinbase: true}
+		undo.Created_Outputs = append(undo.Created_Outputs, out_point)
+		return nil
+	}
+
+	if len(coinbase.Outputs) != 0 || !is_valid_address(coinbase.To) {
+		return fmt.Errorf("coinbase should pay a valid address")
+	}
+	if coinbase.Amount != expected {
+		return fmt.Errorf("coinbase pays %d instead of %d", coinbase.Amount, expected)
+	}
+	if ledger.Coinbase_Maturity == 0 {
+		ledger.__record_account(coinbase.To, undo)
+		account := ledger.get_account(coinbase.To)
+		account.Balance += coinbase.Amount
+		ledger.Accounts[coinbase.To] = account
+		return nil
+	}
+	mature_at := height + ledger.Coinbase_Maturity
+	if ledger.Immature[mature_at] == nil {
+		ledger.Immature[mature_at] = make(map[string]uint64)
+	}
+	ledger.Immature[mature_at][coinbase.To] += coinbase.Amount
+	undo.Rewarded, undo.Reward = coinbase.To, coinbase.Amount
+	return nil
+}
+
+// Ledger's method disconnect_block reverts the changes made by the block that was connected last
+func (ledger *Ledger) disconnect_block(block_hash Hash) error {
+	undo, ok := ledger.Undo[block_hash]
+	if !ok {
+		return fmt.Errorf("no undo data for block %s", block_hash.to_string())
+	}
+	ledger.__revert(undo)
+	delete(ledger.Undo, block_hash)
+	ledger.Height--
+	return nil
+}
+
+// Ledger's method __revert reverts the changes recorded in the undo data of the block at undo.Height, which may be
+// only partly applied
+func (ledger *Ledger) __revert(undo LedgerUndo) {
+	for address, account := range undo.Accounts {
+		if account == (Account{}) {
+			delete(ledger.Accounts, address)
+		} else {
+			ledger.Accounts[address] = account
+		}
+	}
+	for _, out_point := range undo.Created_Outputs {
+		delete(ledger.Utxos, out_point)
+	}
+	for out_point, entry := range undo.Spent_Outputs {
+		ledger.Utxos[out_point] = entry
+	}
+	if undo.Reward > 0 {
+		mature_at := undo.Height + ledger.Coinbase_Maturity
+		ledger.Immature[mature_at][undo.Rewarded] -= undo.Reward
+		if ledger.Immature[mature_at][undo.Rewarded] == 0 {
+			delete(ledger.Immature[mature_at], undo.Rewarded)
+		}
+		if len(ledger.Immature[mature_at]) == 0 {
+			delete(ledger.Immature, mature_at)
+		}
+	}
+	if undo.Released != nil {
+		// copied since the undo data may be shared with copies of the ledger
+		ledger.Immature[undo.Height] = make(map[string]uint64, len(undo.Released))
+		for address, reward := range undo.Released {
+			ledger.Immature[undo.Height][address] = reward
+		}
+	}
+}
+
+// Ledger's method reorganize moves the ledger from the end of old_chain to the end of new_chain. both chains start
+// right after the same block, which is already connected: the blocks of old_chain are disconnected (newest first) and
+// the blocks of new_chain are connected. if a block can not be disconnected or connected, the blocks connected so far
+// are disconnected and the ones disconnected are connected again, leaving the ledger unchanged
+func (ledger *Ledger) reorganize(old_chain []Block, new_chain []Block, merkel_trees map[Hash]MerkelTree) error {
+	err, disconnected, connected := error(nil), 0, 0
+	for err == nil && disconnected < len(old_chain) {
+		if err = ledger.disconnect_block(old_chain[len(old_chain)-1-disconnected].hashed()); err == nil {
+			disconnected++
+		}
+	}
+	for err == nil && connected < len(new_chain) {
+		block := new_chain[connected]
+		if merkel_tree, ok := merkel_trees[block.Merkel_Root]; !ok {
+			err = fmt.Errorf("missing merkel tree of block %s", block.hashed().to_string())
+		} else if err = ledger.connect_block(block.hashed(), merkel_tree); err != nil {
+			err = fmt.Errorf("block %s: %v", block.hashed().to_string(), err)
+		} else {
+			connected++
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	for i := connected - 1; i >= 0; i-- {
+		ledger.disconnect_block(new_chain[i].hashed())
+	}
+	for i := len(old_chain) - disconnected; i < len(old_chain); i++ {
+		// the blocks were connected before, so they connect again
+		ledger.connect_block(old_chain[i].hashed(), merkel_trees[old_chain[i].Merkel_Root])
+	}
+	return err
+}
+
+// Ledger's method prune_undo drops the undo data of the connected blocks at the given height or below, which are final
+// and never disconnected
+func (ledger *Ledger) prune_undo(height uint64) {
+	for block_hash, undo := range ledger.Undo {
+		if undo.Height <= height {
+			delete(ledger.Undo, block_hash)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// Type MempoolLimits holds the bounds of a peer's pool of pending transactions
+type MempoolLimits struct {
+	Max_Count int   // transactions kept at most
+	Max_Bytes int   // bytes of the wire encodings of the transactions kept at most
+	Expiry    int64 // seconds a transaction stays in the pool without being included in a block
+}
+
+func default_mempool_limits() MempoolLimits {
+	return MempoolLimits{Max_Count: 5000, Max_Bytes: 8 << 20, Expiry: 3600}
+}
+
+// Type MempoolEntry holds a pending transaction along with its hash, its size and the time it entered the pool
+type MempoolEntry struct {
+	Transaction Transaction
+	Hash        Hash
+	Size        int // bytes of the transaction's wire encoding
+	Added_At    int64
+}
+
+// Type Mempool holds the transactions a peer received or created that are not in its best chain yet. when it is full a
+// transaction only gets in by evicting transactions paying a lower fee per byte
+type Mempool struct {
+	Entries  map[Hash]MempoolEntry
+	Spenders map[Hash]map[Hash]bool   // {transaction hash: hashes of the entries spending its outputs}
+	Senders  map[string]map[Hash]bool // {address: hashes of the entries it sent}
+	Bytes    int                      // sum of the sizes of the entries
+	Version  uint64                   // incremented whenever a transaction enters or leaves the pool
+	Limits   MempoolLimits
+	Added    uint64 // transactions that entered the pool
+	Evicted  uint64 // transactions removed to make room for ones paying more
+	Expired  uint64 // transactions removed after Limits.Expiry seconds
+	Rejected uint64 // transactions refused because the pool was full of ones paying as much or more
+}
+
+// Type MempoolStats holds a summary of a mempool
+type MempoolStats struct {
+	Count, Bytes                      int
+	Min_Fee_Rate, Max_Fee_Rate        float64 // fee per byte
+	Added, Evicted, Expired, Rejected uint64
+}
+
+func (stats MempoolStats) to_string() string {
+	return fmt.Sprintf("%d transactions, %d bytes, fee rate %.4f to %.4f per byte, %d added, %d evicted, %d expired, %d rejected",
+		stats.Count, stats.Bytes, stats.Min_Fee_Rate, stats.Max_Fee_Rate, stats.Added, stats.Evicted, stats.Expired, stats.Rejected)
+}
+
+func create_mempool(limits MempoolLimits) *Mempool {
+	return &Mempool{Entries: make(map[Hash]MempoolEntry), Spenders: make(map[Hash]map[Hash]bool), Senders: make(map[string]map[Hash]bool), Limits: limits}
+}
+
+// MempoolEntry's method pays_less returns true if the entry pays a lower fee per byte than the other entry. entries
+// paying the same are ordered by their transactions so that the order does not depend on the map
+func (entry MempoolEntry) pays_less(other MempoolEntry) bool {
+	// compare fee / size as fee * other size against other fee * size in 128 bits
+	hi, lo := bits.Mul64(entry.Transaction.Fee, uint64(other.Size))
+	other_hi, other_lo := bits.Mul64(other.Transaction.Fee, uint64(entry.Size))
+	if hi != other_hi || lo != other_lo {
+		return hi < other_hi || (hi == other_hi && lo < other_lo)
+	}
+	return other.Transaction.less_hashed(other.Hash, entry.Transaction, entry.Hash)
+}
+
+func (entry MempoolEntry) fee_rate() float64 {
+	return float64(entry.Transaction.Fee) / float64(entry.Size)
+}
+
+// function depends_on returns true if the transaction can only be applied after the other entry's: it is a later
+// account transaction of the same sender or it spends an output of the other one
+func depends_on(transaction Transaction, other MempoolEntry) bool {
+	if !transaction.is_utxo() {
+		return !other.Transaction.is_utxo() && transaction.From == other.Transaction.From && transaction.Nonce > other.Transaction.Nonce
+	}
+	for _, input := range transaction.Inputs {
+		if input.Transaction == other.Hash {
+			return true
+		}
+	}
+	return false
+}
+
+func (mempool *Mempool) has(transaction_hash Hash) bool {
+	_, ok := mempool.Entries[transaction_hash]
+	return ok
+}
+
+func (mempool *Mempool) get(transaction_hash Hash) (Transaction, bool) {
+	entry, ok := mempool.Entries[transaction_hash]
+	return entry.Transaction, ok
+}
+
+func (mempool *Mempool) count() int {
+	return len(mempool.Entries)
+}
+
+// Mempool's method add adds a transaction to the pool. if the pool is full, the transactions paying the lowest fee per
+// byte are evicted along with the transactions depending on them until the new one fits. the transaction is refused
+// if it is already in the pool, does not fit at all, or would have to evict a transaction paying as much or more or
+// one it depends on. returns the evicted transactions and whether the transaction was added
+func (mempool *Mempool) add(transaction Transaction) ([]Transaction, bool) {
+	transaction_hash := transaction.hashed()
+	if mempool.has(transaction_hash) {
+		return nil, false
+	}
+	entry := MempoolEntry{Transaction: transaction, Hash: transaction_hash, Size: len(transaction.encode_wire()), Added_At: time.Now().Unix()}
+	if entry.Size > mempool.Limits.Max_Bytes || mempool.Limits.Max_Count < 1 {
+		mempool.Rejected++
+		return nil, false
+	}
+
+	evicted, count, size := make(map[Hash]bool), len(mempool.Entries), mempool.Bytes
+	fits := func() bool { return count < mempool.Limits.Max_Count && size+entry.Size <= mempool.Limits.Max_Bytes }
+	candidates := make([]MempoolEntry, 0)
+	if !fits() {
+		candidates = mempool.__by_fee_rate(false)
+	}
+	for _, candidate := range candidates {
+		if fits() {
+			break
+		}
+		if evicted[candidate.Hash] {
+			continue
+		}
+		if !candidate.pays_less(entry) {
+			mempool.Rejected++
+			return nil, false
+		}
+		for descendant_hash := range mempool.__descendants(candidate.Hash) {
+			if depends_on(transaction, mempool.Entries[descendant_hash]) {
+				mempool.Rejected++
+				return nil, false
+			}
+			if !evicted[descendant_hash] {
+				evicted[descendant_hash] = true
+				count, size = count-1, size-mempool.Entries[descendant_hash].Size
+			}
+		}
+	}
+
+	removed := make([]Transaction, 0, len(evicted))
+	for evicted_hash := range evicted {
+		removed = append(removed, mempool.Entries[evicted_hash].Transaction)
+		mempool.remove(evicted_hash)
+	}
+	mempool.Evicted += uint64(len(removed))
+	mempool.Entries[transaction_hash] = entry
+	mempool.Bytes += entry.Size
+	mempool.Added++
+	mempool.Version++
+	for _, input := range transaction.Inputs {
+		if mempool.Spenders[input.Transaction] == nil {
+			mempool.Spenders[input.Transaction] = make(map[Hash]bool)
+		}
+		mempool.Spenders[input.Transaction][transaction_hash] = true
+	}
+	if mempool.Senders[transaction.From] == nil {
+		mempool.Senders[transaction.From] = make(map[Hash]bool)
+	}
+	mempool.Senders[transaction.From][transaction_hash] = true
+	return removed, true
+}
+
+// Mempool's method remove removes the transaction with the given hash if it is in the pool
+func (mempool *Mempool) remove(transaction_hash Hash) {
+	entry, ok := mempool.Entries[transaction_hash]
+	if !ok {
+		return
+	}
+	delete(mempool.Entries, transaction_hash)
+	mempool.Bytes -= entry.Size
+	mempool.Version++
+	for _, input := range entry.Transaction.Inputs {
+		if delete(mempool.Spenders[input.Transaction], transaction_hash); len(mempool.Spenders[input.Transaction]) == 0 {
+			delete(mempool.Spenders, input.Transaction)
+		}
+	}
+	if delete(mempool.Senders[entry.Transaction.From], transaction_hash); len(mempool.Senders[entry.Transaction.From]) == 0 {
+		delete(mempool.Senders, entry.Transaction.From)
+	}
+}
+
+// Mempool's method __descendants returns the hash of the given transaction along with the hashes of the transactions
+// in the pool that depend on it directly or through other transactions in the pool. the spenders of a transaction and
+// the later transactions of an account transaction's sender are looked up in the pool's indexes
+func (mempool *Mempool) __descendants(transaction_hash Hash) map[Hash]bool {
+	descendants := map[Hash]bool{transaction_hash: true}
+	for queue := []Hash{transaction_hash}; len(queue) > 0; queue = queue[1:] {
+		ancestor := mempool.Entries[queue[0]]
+		for candidate_hash := range mempool.Spenders[ancestor.Hash] {
+			if !descendants[candidate_hash] {
+				descendants[candidate_hash] = true
+				queue = append(queue, candidate_hash)
+			}
+		}
+		if ancestor.Transaction.is_utxo() {
+			continue
+		}
+		for candidate_hash := range mempool.Senders[ancestor.Transaction.From] {
+			if !descendants[candidate_hash] && depends_on(mempool.Entries[candidate_hash].Transaction, ancestor) {
+				descendants[candidate_hash] = true
+				queue = append(queue, candidate_hash)
+			}
+		}
+	}
+	return descendants
+}
+
+// Mempool's method spends returns true if an entry spends the given output
+func (mempool *Mempool) spends(out_point OutPoint) bool {
+	for spender_hash := range mempool.Spenders[out_point.Transaction] {
+		for _, input := range mempool.Entries[spender_hash].Transaction.Inputs {
+			if input == out_point {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Mempool's method creates returns true if an entry creates the given output
+func (mempool *Mempool) creates(out_point OutPoint) bool {
+	entry, ok := mempool.Entries[out_point.Transaction]
+	return ok && int(out_point.Index) < len(entry.Transaction.Outputs)
+}
+
+// Mempool's method remove_unspendable removes the transactions spending an output that is neither unspent in the
+// given ledger nor created by another transaction in the pool, along with the transactions depending on them, and
+// returns how many were removed. the transactions spending the outputs of a removed one are among its descendants, so
+// a single pass leaves only spendable transactions
+func (mempool *Mempool) remove_unspendable(ledger Ledger) int {
+	removed := 0
+	for transaction_hash, entry := range mempool.Entries {
+		if !mempool.has(transaction_hash) {
+			continue // removed as a descendant of an earlier one
+		}
+		for _, input := range entry.Transaction.Inputs {
+			if _, unspent := ledger.Utxos[input]; !unspent && !mempool.creates(input) {
+				for descendant_hash := range mempool.__descendants(transaction_hash) {
+					mempool.remove(descendant_hash)
+					removed++
+				}
+				break
+			}
+		}
+	}
+	return removed
+}
+
+// Mempool's method expire removes the transactions that entered the pool more than Limits.Expiry seconds ago along
+// with the transactions depending on them, and returns how many were removed
+func (mempool *Mempool) expire() int {
+	now, expired := time.Now().Unix(), make(map[Hash]bool)
+	for transaction_hash, entry := range mempool.Entries {
+		if now-entry.Added_At > mempool.Limits.Expiry && !expired[transaction_hash] {
+			for descendant_hash := range mempool.__descendants(transaction_hash) {
+				expired[descendant_hash] = true
+			}
+		}
+	}
+	for transaction_hash := range expired {
+		mempool.remove(transaction_hash)
+	}
+	mempool.Expired += uint64(len(expired))
+	return len(expired)
+}
+
+// Mempool's method __by_fee_rate returns the entries ordered by their fee per byte, the highest first if descending
+func (mempool *Mempool) __by_fee_rate(descending bool) []MempoolEntry {
+	entries := get_map_values(mempool.Entries)
+	sort.Slice(entries, func(i, j int) bool {
+		if descending {
+			return entries[j].pays_less(entries[i])
+		}
+		return entries[i].pays_less(entries[j])
+	})
+	return entries
+}
+
+// Mempool's method pending returns the transactions in the pool, the ones paying the highest fee per byte first
+func (mempool *Mempool) pending() []Transaction {
+	transactions := make([]Transaction, 0, len(mempool.Entries))
+	for _, entry := range mempool.__by_fee_rate(true) {
+		transactions = append(transactions, entry.Transaction)
+	}
+	return transactions
+}
+
+// Mempool's method pending_from returns the transactions in the pool sent from the given address in the order they
+// apply in
+func (mempool *Mempool) pending_from(address string) []Transaction {
+	transactions := make([]Transaction, 0, len(mempool.Senders[address]))
+	for transaction_hash := range mempool.Senders[address] {
+		transactions = append(transactions, mempool.Entries[transaction_hash].Transaction)
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].less(transactions[j])
+	})
+	return transactions
+}
+
+// Mempool's method stats returns a summary of the pool, finding the lowest and highest fee rates in a single pass
+func (mempool *Mempool) stats() MempoolStats {
+	stats := MempoolStats{Count: len(mempool.Entries), Bytes: mempool.Bytes, Added: mempool.Added, Evicted: mempool.Evicted, Expired: mempool.Expired, Rejected: mempool.Rejected}
+	first := true
+	for _, entry := range mempool.Entries {
+		if fee_rate := entry.fee_rate(); first {
+			stats.Min_Fee_Rate, stats.Max_Fee_Rate, first = fee_rate, fee_rate, false
+		} else {
+			stats.Min_Fee_Rate, stats.Max_Fee_Rate = min(stats.Min_Fee_Rate, fee_rate), max(stats.Max_Fee_Rate, fee_rate)
+		}
+	}
+	return stats
+}
+
+// Mempool's method select_transactions returns at most limit transactions of the pool for a block template. the ones
+// paying the highest fee per byte are taken first, as long as they can be applied to the given ledger once the ones
+// taken before them are. since a block applies its transactions in the order of its leaves, the taken transactions
+// that can not be applied in that order are left out. the transactions leave room for the coinbase in a merkel tree
+// of max_merkel_tree_size bytes. neither the pool nor the ledger is changed
+func (mempool *Mempool) select_transactions(ledger Ledger, limit int) []Transaction {
+	candidates := mempool.__by_fee_rate(true)
+	scratch, budget := ledger.copy(), max_merkel_tree_size-4-max_transaction_size
+	selected := make([]Transaction, 0, limit)
+	for progress := true; progress && len(selected) < limit; {
+		// a transaction can become valid once one paying less has been taken, e.g. an earlier nonce of its sender, so
+		// keep passing over the remaining candidates until no more can be applied
+		progress = false
+		remaining := candidates[:0]
+		for _, entry := range candidates {
+			if len(selected) < limit && entry.Size <= budget && scratch.apply_transaction(entry.Transaction, nil) == nil {
+				selected = append(selected, entry.Transaction)
+				budget -= entry.Size
+				progress = true
+			} else {
+				remaining = append(remaining, entry)
+			}
+		}
+		candidates = remaining
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].less(selected[j])
+	})
+	scratch = ledger.copy()
+	in_order := selected[:0]
+	for _, transaction := range selected {
+		if scratch.apply_transaction(transaction, nil) == nil {
+			in_order = append(in_order, transaction)
+		}
+	}
+	return in_order
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -65,6 +66,40 @@ func (merkel_tree MerkelTree) get_transactions() map[Hash]Transaction {
 	return merkel_tree.Transactions
 }
 
+// MerkelTree's method ordered_transactions returns the transactions sorted in the order they are placed in the leaves
+func (merkel_tree MerkelTree) ordered_transactions() []Transaction {
+	transactions, _ := merkel_tree.__ordered_leaves()
+	return transactions
+}
+
+// MerkelTree's method __ordered_leaves returns the transactions in the order of the leaves along with their hashes.
+// the hashes are the keys of Transactions, so no transaction is hashed again
+func (merkel_tree MerkelTree) __ordered_leaves() ([]Transaction, []Hash) {
+	hashes := make([]Hash, 0, len(merkel_tree.Transactions))
+	transactions := make([]Transaction, 0, len(merkel_tree.Transactions))
+	for transaction_hash, transaction := range merkel_tree.Transactions {
+		hashes = append(hashes, transaction_hash)
+		transactions = append(transactions, transaction)
+	}
+	sort.Sort(LeafOrder{Transactions: transactions, Hashes: hashes})
+	return transactions, hashes
+}
+
+// Type LeafOrder sorts transactions into the order of the leaves of a merkel tree along with their hashes
+type LeafOrder struct {
+	Transactions []Transaction
+	Hashes       []Hash
+}
+
+func (order LeafOrder) Len() int { return len(order.Hashes) }
+func (order LeafOrder) Less(i, j int) bool {
+	return order.Transactions[i].less_hashed(order.Hashes[i], order.Transactions[j], order.Hashes[j])
+}
+func (order LeafOrder) Swap(i, j int) {
+	order.Transactions[i], order.Transactions[j] = order.Transactions[j], order.Transactions[i]
+	order.Hashes[i], order.Hashes[j] = order.Hashes[j], order.Hashes[i]
+}
+
 // MerkelTree's function build creates the tree after all the transactions have been added
 func (merkel_tree *MerkelTree) build() {
 	if merkel_tree.Is_Built {
@@ -76,18 +111,17 @@ func (merkel_tree *MerkelTree) build() {
 	}
 	merkel_tree.Tree = make([]MerkelTreeNode, 2*tree_base_size-1)
 	idx := tree_base_size - 1
-	for _, transaction := range merkel_tree.Transactions {
-		merkel_tree.Tree[idx] = MerkelTreeNode{Transaction: transaction}
+	transactions, hashes := merkel_tree.__ordered_leaves()
+	for i, transaction := range transactions {
+		merkel_tree.Tree[idx] = MerkelTreeNode{Transaction: transaction, Self_Hash: hashes[i]}
 		idx++
 	}
 	for ; idx < 2*tree_base_size-1; idx++ {
 		merkel_tree.Tree[idx] = merkel_tree.Tree[idx-1]
 	}
-	for i := 2*tree_base_size - 2; i >= 0; i-- {
-		if i < tree_base_size-1 {
-			merkel_tree.Tree[i].Left_Child = merkel_tree.Tree[i*2+1].Self_Hash
-			merkel_tree.Tree[i].Right_Child = merkel_tree.Tree[i*2+2].Self_Hash
-		}
+	for i := tree_base_size - 2; i >= 0; i-- {
+		merkel_tree.Tree[i].Left_Child = merkel_tree.Tree[i*2+1].Self_Hash
+		merkel_tree.Tree[i].Right_Child = merkel_tree.Tree[i*2+2].Self_Hash
 		merkel_tree.Tree[i].Self_Hash = merkel_tree.Tree[i].hashed()
 	}
 	merkel_tree.Is_Built = true
@@ -96,19 +130,37 @@ func (merkel_tree *MerkelTree) build() {
 // MerkelTree function is_valid determines whether the built merkel tree is valid.
 //
 // For a MerkelTree to be valid, the tree should be a perfect binary tree and hold
-// the property that all non leaf nodes have the hash value of their children's hash
+// the property that all non leaf nodes have the hash value of their children's hash.
+// the leaves should hold exactly the tree's transactions in order, with the last one repeated as padding
 func (merkel_tree MerkelTree) is_valid() bool {
-	if !merkel_tree.Is_Built {
+	if !merkel_tree.Is_Built || len(merkel_tree.Transactions) == 0 {
+		return false
+	}
+	leaves := (len(merkel_tree.Tree) + 1) / 2
+	if leaves&(leaves-1) != 0 || leaves < len(merkel_tree.Transactions) {
 		return false
 	}
-	non_leaf := (len(merkel_tree.Tree) - 3) / 2
-	for i := 0; i < len(merkel_tree.Tree); i++ {
-		if merkel_tree.Tree[i].Self_Hash != merkel_tree.Tree[i].hashed() {
+	_, hashes := merkel_tree.__ordered_leaves()
+	for i := 0; i < leaves; i++ {
+		leaf := merkel_tree.Tree[leaves-1+i]
+		if !leaf.Transaction.Not_Null || leaf.Self_Hash != hashes[min(i, len(hashes)-1)] || leaf.Self_Hash != leaf.hashed() {
+			return false
+		}
+	}
+	for i := 0; i < leaves-1; i++ {
+		node := merkel_tree.Tree[i]
+		if node.Left_Child != merkel_tree.Tree[i*2+1].Self_Hash || node.Right_Child != merkel_tree.Tree[i*2+2].Self_Hash || node.Self_Hash != node.hashed() {
 			return false
 		}
-		if i <= non_leaf &&
-			(merkel_tree.Tree[i].Left_Child != merkel_tree.Tree[i*2+1].Self_Hash ||
-				merkel_tree.Tree[i].Right_Child != merkel_tree.Tree[i*2+2].Self_Hash) {
+	}
+	return true
+}
+
+// MerkelTree's method has_valid_signatures checks whether every transaction in the tree, except the coinbase, is
+// signed by its sender
+func (merkel_tree MerkelTree) has_valid_signatures() bool {
+	for _, transaction := range merkel_tree.Transactions {
+		if !transaction.Is_Coinbase && !transaction.has_valid_signature() {
 			return false
 		}
 	}
@@ -123,7 +175,7 @@ func (merkel_tree MerkelTree) pretty_print() string {
 	for idx, merkel_node := range merkel_tree.Tree {
 		out += fmt.Sprintf("%.2d) %s", idx+1, merkel_node.Self_Hash.to_string())
 		if idx >= leaves-1 {
-			out += fmt.Sprintf(":%s", merkel_node.Transaction.Value)
+			out += fmt.Sprintf(":%s", merkel_node.Transaction.to_string())
 		}
 		out += "\n"
 	}
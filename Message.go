@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// error wrapped by every error about a packet that breaks the wire format or its size limits
+var err_malformed_packet = errors.New("malformed packet")
+
+// size of the part of a packet that comes before its message: magic, chain id, protocol version, request type and sender
+const packet_prefix_size = 4 + 32 + 4 + 1 + 4 + 2
+
+// limits on the parts of messages that have no natural bound
+const (
+	max_software_version_size   = 256      // bytes of the software version in a handshake
+	max_transaction_size        = 64 << 10 // bytes of a single encoded transaction
+	max_merkel_tree_size        = 1 << 20  // bytes of the encoded merkel tree of a block, the miner fills blocks up to it
+	max_ip_port_list_size       = 1024     // addresses in an ip port list
+	max_locator_size            = 64       // hashes in a block locator
+	max_headers_count           = 2000     // block headers in a headers message
+	max_block_bodies_count      = 128      // block bodies asked for in a single request
+	max_block_bodies_size       = 4 << 20  // bytes of the merkel trees in a block bodies message
+	max_get_blocks_count        = 128      // blocks sent back for a get blocks request, fewer than a write queue holds
+	max_inventory_size          = 1000     // items in an inv or get data message
+	max_block_transaction_count = 1 << 13  // transactions of a compact block, more than a signed transaction each fit in a merkel tree
+	max_address_size            = 64       // bytes of the address a mempool query is restricted to
+	max_mempool_reply_size      = 1 << 20  // bytes of the transactions in a mempool message
+)
+
+// function max_packet_size returns the size of the longest valid packet of the given request type, so that a frame
+// announcing a longer packet is refused before it is read. returns false for an unknown request type
+func max_packet_size(req_type int) (int, bool) {
+	switch req_type {
+	case req_type_reject_connection, req_type_need_ip_port_list, req_type_hello, req_type_hi:
+		return packet_prefix_size, true
+	case req_type_new_connection, req_type_accept_connection:
+		return packet_prefix_size + 4 + 4 + max_software_version_size + 8 + 8 + 32 + 32, true
+	case req_type_new_transaction, req_type_submit_transaction:
+		return packet_prefix_size + max_transaction_size, true
+	case req_type_new_block:
+		return packet_prefix_size + block_header_size + max_merkel_tree_size, true
+	case req_type_need_block:
+		return packet_prefix_size + 32, true
+	case req_type_ip_port_list:
+		return packet_prefix_size + 4 + (4+2)*max_ip_port_list_size, true
+	case req_type_get_headers, req_type_get_blocks:
+		return packet_prefix_size + 4 + 32*max_locator_size + 32, true
+	case req_type_headers:
+		return packet_prefix_size + 4 + block_header_size*max_headers_count, true
+	case req_type_get_block_bodies:
+		return packet_prefix_size + 4 + 32*max_block_bodies_count, true
+	case req_type_inv, req_type_get_data:
+		return packet_prefix_size + 4 + (1+32)*max_inventory_size, true
+	case req_type_compact_block:
+		return packet_prefix_size + block_header_size + 8 + 4 + short_id_size*max_block_transaction_count + 4 + max_merkel_tree_size, true
+	case req_type_get_block_transactions:
+		return packet_prefix_size + 32 + 4 + 4*max_block_transaction_count, true
+	case req_type_block_transactions:
+		return packet_prefix_size + 32 + 4 + max_merkel_tree_size, true
+	case req_type_block_bodies:
+		return packet_prefix_size + 4 + max_block_bodies_size, true
+	case req_type_get_mempool:
+		return packet_prefix_size + 4 + max_address_size, true
+	case req_type_mempool:
+		return packet_prefix_size + mempool_stats_size + 4 + max_mempool_reply_size, true
+	}
+	return 0, false
+}
+
+// Type Message is the body of a network packet. there is one message type per request type and each one encodes only
+// its own fields, in the order they are declared
+type Message interface {
+	req_type() int
+	encode_wire() []byte
+}
+
+// Type NewConnectionMessage asks the receiver to become a neighbour of the sender
+type NewConnectionMessage struct {
+	Handshake Handshake
+}
+
+// Type AcceptConnectionMessage tells the sender of a new connection request that it became a neighbour
+type AcceptConnectionMessage struct {
+	Handshake Handshake
+}
+
+// Type RejectConnectionMessage tells the sender of a new connection request that it was refused
+type RejectConnectionMessage struct{}
+
+// Type NewTransactionMessage relays a transaction between neighbours
+type NewTransactionMessage struct {
+	Transaction Transaction
+}
+
+// Type SubmitTransactionMessage hands a transaction to a peer from a client that is not a peer, e.g. a wallet
+type SubmitTransactionMessage struct {
+	Transaction Transaction
+}
+
+// Type NewBlockMessage relays a block along with its merkel tree
+type NewBlockMessage struct {
+	Block       Block
+	Merkel_Tree MerkelTree
+}
+
+// Type NeedBlockMessage asks for the block with the given hash
+type NeedBlockMessage struct {
+	Block_Hash Hash
+}
+
+// Type NeedIpPortListMessage asks the bootstrap peer for the members of the network
+type NeedIpPortListMessage struct{}
+
+// Type IpPortListMessage holds the members of the network sent by the bootstrap peer
+type IpPortListMessage struct {
+	Ip_Port_List []Address
+}
+
+// Type HelloMessage checks that the receiver is still in the network
+type HelloMessage struct{}
+
+// Type HiMessage answers a hello
+type HiMessage struct{}
+
+// Type GetHeadersMessage asks for the headers of the best chain of the receiver that follow the first block of the
+// locator on that chain, up to and including the stop block. a zero stop hash asks for as many as fit in one message
+type GetHeadersMessage struct {
+	Locator []Hash // hashes of the sender's chain from its tip back to the genisys node, exponentially spaced
+	Stop    Hash
+}
+
+// Type GetBlocksMessage asks for the blocks that lead from the last block of the locator on the receiver's chain to
+// the stop block, each sent back as a new block message in order. a zero stop hash stands for the receiver's tip
+type GetBlocksMessage struct {
+	Locator []Hash
+	Stop    Hash
+}
+
+// Type InvMessage announces transactions and blocks the sender has by their hashes
+type InvMessage struct {
+	Items []InvItem
+}
+
+// Type GetDataMessage asks for announced items, each sent back in a new transaction or new block message
+type GetDataMessage struct {
+	Items []InvItem
+}
+
+// Type CompactBlockMessage relays a block as its header, the short ids of its transactions and the transactions no
+// other peer has, in the order of the leaves of its merkel tree. the receiver rebuilds the block from the
+// transactions it has and asks for the others with a get block transactions message
+type CompactBlockMessage struct {
+	Block     Block
+	Nonce     uint64   // picked by the sender, the short ids are made with a key of the block header and the nonce
+	Short_Ids []uint64 // short_id_size bytes each
+	Prefilled []PrefilledTransaction
+}
+
+// Type GetBlockTransactionsMessage asks for the transactions at the given leaves of a block
+type GetBlockTransactionsMessage struct {
+	Block_Hash Hash
+	Indexes    []uint32
+}
+
+// Type BlockTransactionsMessage answers a get block transactions request with the transactions in the requested order
+type BlockTransactionsMessage struct {
+	Block_Hash   Hash
+	Transactions []Transaction
+}
+
+// Type HeadersMessage answers a get headers request with block headers in order, fewer than max_headers_count tell
+// the receiver that the sender has no more
+type HeadersMessage struct {
+	Headers []Block
+}
+
+// Type GetBlockBodiesMessage asks for the merkel trees of the blocks with the given hashes
+type GetBlockBodiesMessage struct {
+	Block_Hashes []Hash
+}
+
+// Type BlockBodiesMessage answers a get block bodies request with the merkel trees the sender has, in the requested
+// order. bodies that would make the message longer than max_block_bodies_size are left out
+type BlockBodiesMessage struct {
+	Merkel_Trees []MerkelTree
+}
+
+// Type GetMempoolMessage asks a peer for the transactions in its pool, only the ones sent from the given address
+// unless it is empty. it is sent by clients that are not peers, e.g. the mempool command
+type GetMempoolMessage struct {
+	Address string
+}
+
+// Type MempoolMessage answers a get mempool request with a summary of the pool and the requested transactions, the
+// ones paying the highest fee per byte first. transactions that would make the message longer than
+// max_mempool_reply_size are left out
+type MempoolMessage struct {
+	Stats        MempoolStats
+	Transactions []Transaction
+}
+
+func (message NewConnectionMessage) req_type() int        { return req_type_new_connection }
+func (message AcceptConnectionMessage) req_type() int     { return req_type_accept_connection }
+func (message RejectConnectionMessage) req_type() int     { return req_type_reject_connection }
+func (message NewTransactionMessage) req_type() int       { return req_type_new_transaction }
+func (message SubmitTransactionMessage) req_type() int    { return req_type_submit_transaction }
+func (message NewBlockMessage) req_type() int             { return req_type_new_block }
+func (message NeedBlockMessage) req_type() int            { return req_type_need_block }
+func (message NeedIpPortListMessage) req_type() int       { return req_type_need_ip_port_list }
+func (message IpPortListMessage) req_type() int           { return req_type_ip_port_list }
+func (message HelloMessage) req_type() int                { return req_type_hello }
+func (message HiMessage) req_type() int                   { return req_type_hi }
+func (message GetHeadersMessage) req_type() int           { return req_type_get_headers }
+func (message HeadersMessage) req_type() int              { return req_type_headers }
+func (message GetBlocksMessage) req_type() int            { return req_type_get_blocks }
+func (message InvMessage) req_type() int                  { return req_type_inv }
+func (message GetDataMessage) req_type() int              { return req_type_get_data }
+func (message CompactBlockMessage) req_type() int         { return req_type_compact_block }
+func (message GetBlockTransactionsMessage) req_type() int { return req_type_get_block_transactions }
+func (message BlockTransactionsMessage) req_type() int    { return req_type_block_transactions }
+func (message GetBlockBodiesMessage) req_type() int       { return req_type_get_block_bodies }
+func (message BlockBodiesMessage) req_type() int          { return req_type_block_bodies }
+func (message GetMempoolMessage) req_type() int           { return req_type_get_mempool }
+func (message MempoolMessage) req_type() int              { return req_type_mempool }
+
+func (message NewConnectionMessage) encode_wire() []byte {
+	return message.Handshake.encode_wire()
+}
+
+func (message AcceptConnectionMessage) encode_wire() []byte {
+	return message.Handshake.encode_wire()
+}
+
+func (message RejectConnectionMessage) encode_wire() []byte {
+	return nil
+}
+
+func (message NewTransactionMessage) encode_wire() []byte {
+	return message.Transaction.encode_wire()
+}
+
+func (message SubmitTransactionMessage) encode_wire() []byte {
+	return message.Transaction.encode_wire()
+}
+
+// NewBlockMessage's method encode_wire returns the block header followed by the merkel tree
+func (message NewBlockMessage) encode_wire() []byte {
+	return append(message.Block.encode_header(), message.Merkel_Tree.encode_wire()...)
+}
+
+func (message NeedBlockMessage) encode_wire() []byte {
+	return message.Block_Hash.Value[:]
+}
+
+func (message NeedIpPortListMessage) encode_wire() []byte {
+	return nil
+}
+
+// IpPortListMessage's method encode_wire returns the number of addresses followed by each address as its 4 byte ip
+// and 2 byte port
+func (message IpPortListMessage) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(message.Ip_Port_List)))
+	for _, address := range message.Ip_Port_List {
+		buf = append_address(buf, address)
+	}
+	return buf
+}
+
+func (message HelloMessage) encode_wire() []byte {
+	return nil
+}
+
+func (message HiMessage) encode_wire() []byte {
+	return nil
+}
+
+// GetHeadersMessage's method encode_wire returns the locator as a list of hashes followed by the stop hash
+func (message GetHeadersMessage) encode_wire() []byte {
+	return append(append_hashes(nil, message.Locator), message.Stop.Value[:]...)
+}
+
+// GetBlocksMessage's method encode_wire returns the locator as a list of hashes followed by the stop hash
+func (message GetBlocksMessage) encode_wire() []byte {
+	return append(append_hashes(nil, message.Locator), message.Stop.Value[:]...)
+}
+
+func (message InvMessage) encode_wire() []byte {
+	return append_inventory(nil, message.Items)
+}
+
+func (message GetDataMessage) encode_wire() []byte {
+	return append_inventory(nil, message.Items)
+}
+
+// CompactBlockMessage's method encode_wire returns the block header, the nonce, the short ids as a list and the
+// prefilled transactions as a list, each one its leaf index followed by the transaction
+func (message CompactBlockMessage) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint64(message.Block.encode_header(), message.Nonce)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(message.Short_Ids)))
+	for _, id := range message.Short_Ids {
+		buf = append(buf, binary.BigEndian.AppendUint64(nil, id)[8-short_id_size:]...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(message.Prefilled)))
+	for _, prefilled := range message.Prefilled {
+		buf = binary.BigEndian.AppendUint32(buf, prefilled.Index)
+		buf = append(buf, prefilled.Transaction.encode_wire()...)
+	}
+	return buf
+}
+
+// GetBlockTransactionsMessage's method encode_wire returns the block hash followed by the leaf indexes as a list
+func (message GetBlockTransactionsMessage) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint32(append([]byte{}, message.Block_Hash.Value[:]...), uint32(len(message.Indexes)))
+	for _, idx := range message.Indexes {
+		buf = binary.BigEndian.AppendUint32(buf, idx)
+	}
+	return buf
+}
+
+// BlockTransactionsMessage's method encode_wire returns the block hash followed by the transactions as a list
+func (message BlockTransactionsMessage) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint32(append([]byte{}, message.Block_Hash.Value[:]...), uint32(len(message.Transactions)))
+	for _, transaction := range message.Transactions {
+		buf = append(buf, transaction.encode_wire()...)
+	}
+	return buf
+}
+
+// HeadersMessage's method encode_wire returns the number of headers followed by each header in its canonical encoding
+func (message HeadersMessage) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(message.Headers)))
+	for _, header := range message.Headers {
+		buf = append(buf, header.encode_header()...)
+	}
+	return buf
+}
+
+func (message GetBlockBodiesMessage) encode_wire() []byte {
+	return append_hashes(nil, message.Block_Hashes)
+}
+
+// BlockBodiesMessage's method encode_wire returns the number of merkel trees followed by each merkel tree
+func (message BlockBodiesMessage) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(message.Merkel_Trees)))
+	for _, merkel_tree := range message.Merkel_Trees {
+		buf = append(buf, merkel_tree.encode_wire()...)
+	}
+	return buf
+}
+
+func (message GetMempoolMessage) encode_wire() []byte {
+	return append_string(nil, message.Address)
+}
+
+// MempoolMessage's method encode_wire returns the stats followed by the transactions as a list
+func (message MempoolMessage) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint32(message.Stats.encode_wire(), uint32(len(message.Transactions)))
+	for _, transaction := range message.Transactions {
+		buf = append(buf, transaction.encode_wire()...)
+	}
+	return buf
+}
+
+// WireReader's method read_message reads the body of a packet of the given request type
+func (reader *WireReader) read_message(req_type int) (Message, error) {
+	switch req_type {
+	case req_type_new_connection:
+		return NewConnectionMessage{Handshake: reader.read_handshake()}, nil
+	case req_type_accept_connection:
+		return AcceptConnectionMessage{Handshake: reader.read_handshake()}, nil
+	case req_type_reject_connection:
+		return RejectConnectionMessage{}, nil
+	case req_type_new_transaction:
+		return NewTransactionMessage{Transaction: reader.read_transaction()}, nil
+	case req_type_submit_transaction:
+		return SubmitTransactionMessage{Transaction: reader.read_transaction()}, nil
+	case req_type_new_block:
+		return NewBlockMessage{Block: reader.read_block_header(), Merkel_Tree: reader.read_merkel_tree()}, nil
+	case req_type_need_block:
+		return NeedBlockMessage{Block_Hash: reader.read_hash()}, nil
+	case req_type_need_ip_port_list:
+		return NeedIpPortListMessage{}, nil
+	case req_type_ip_port_list:
+		message := IpPortListMessage{Ip_Port_List: make([]Address, reader.read_count(4+2))}
+		for i := range message.Ip_Port_List {
+			message.Ip_Port_List[i] = reader.read_address()
+		}
+		return message, nil
+	case req_type_hello:
+		return HelloMessage{}, nil
+	case req_type_hi:
+		return HiMessage{}, nil
+	case req_type_get_headers:
+		return GetHeadersMessage{Locator: reader.read_hashes(), Stop: reader.read_hash()}, nil
+	case req_type_headers:
+		message := HeadersMessage{Headers: make([]Block, reader.read_count(block_header_size))}
+		for i := range message.Headers {
+			message.Headers[i] = reader.read_block_header()
+		}
+		return message, nil
+	case req_type_get_blocks:
+		return GetBlocksMessage{Locator: reader.read_hashes(), Stop: reader.read_hash()}, nil
+	case req_type_inv:
+		return InvMessage{Items: reader.read_inventory()}, nil
+	case req_type_get_data:
+		return GetDataMessage{Items: reader.read_inventory()}, nil
+	case req_type_compact_block:
+		message := CompactBlockMessage{Block: reader.read_block_header(), Nonce: reader.read_uint64()}
+		message.Short_Ids = make([]uint64, reader.read_count(short_id_size))
+		for i := range message.Short_Ids {
+			message.Short_Ids[i] = binary.BigEndian.Uint64(append(make([]byte, 8-short_id_size), reader.read_bytes(short_id_size)...))
+		}
+		message.Prefilled = make([]PrefilledTransaction, reader.read_count(4+1))
+		for i := range message.Prefilled {
+			message.Prefilled[i] = PrefilledTransaction{Index: reader.read_uint32(), Transaction: reader.read_transaction()}
+		}
+		return message, nil
+	case req_type_get_block_transactions:
+		message := GetBlockTransactionsMessage{Block_Hash: reader.read_hash()}
+		message.Indexes = make([]uint32, reader.read_count(4))
+		for i := range message.Indexes {
+			message.Indexes[i] = reader.read_uint32()
+		}
+		return message, nil
+	case req_type_block_transactions:
+		message := BlockTransactionsMessage{Block_Hash: reader.read_hash()}
+		message.Transactions = make([]Transaction, reader.read_count(4+1))
+		for i := range message.Transactions {
+			message.Transactions[i] = reader.read_transaction()
+		}
+		return message, nil
+	case req_type_get_block_bodies:
+		return GetBlockBodiesMessage{Block_Hashes: reader.read_hashes()}, nil
+	case req_type_block_bodies:
+		message := BlockBodiesMessage{Merkel_Trees: make([]MerkelTree, reader.read_count(4))}
+		for i := range message.Merkel_Trees {
+			message.Merkel_Trees[i] = reader.read_merkel_tree()
+		}
+		return message, nil
+	case req_type_get_mempool:
+		message := GetMempoolMessage{Address: reader.read_string()}
+		if len(message.Address) > max_address_size && reader.Err == nil {
+			reader.Err = fmt.Errorf("address of %d bytes is too long", len(message.Address))
+		}
+		return message, nil
+	case req_type_mempool:
+		message := MempoolMessage{Stats: reader.read_mempool_stats()}
+		message.Transactions = make([]Transaction, reader.read_count(4+1))
+		for i := range message.Transactions {
+			message.Transactions[i] = reader.read_transaction()
+		}
+		return message, nil
+	}
+	return nil, fmt.Errorf("unknown request type %d", req_type)
+}
+
+// function encode_packet returns the wire encoding of a packet: the header (magic, chain id and protocol version),
+// the request type as a single byte, the sender's address and the message
+func encode_packet(network_packet NetworkPacket) []byte {
+	buf := append([]byte{}, network_packet.Header.Magic[:]...)
+	buf = append(buf, network_packet.Header.Chain_Id.Value[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, network_packet.Header.Protocol_Version)
+	buf = append(buf, uint8(network_packet.Message.req_type()))
+	buf = append_address(buf, network_packet.Req_From)
+	return append(buf, network_packet.Message.encode_wire()...)
+}
+
+// function decode_packet_prefix reads the part of a packet that comes before its message and returns the packet
+// with its header and sender set along with its request type
+func decode_packet_prefix(data []byte) (NetworkPacket, int, error) {
+	network_packet := NetworkPacket{}
+	reader := WireReader{Data: data}
+	copy(network_packet.Header.Magic[:], reader.read_bytes(len(network_packet.Header.Magic)))
+	network_packet.Header.Chain_Id = reader.read_hash()
+	network_packet.Header.Protocol_Version = reader.read_uint32()
+	req_type := int(reader.read_uint8())
+	network_packet.Req_From = reader.read_address()
+	if reader.Err != nil {
+		return network_packet, req_type, fmt.Errorf("%w: %v", err_malformed_packet, reader.Err)
+	}
+	return network_packet, req_type, nil
+}
+
+// function decode_packet reads a packet written by encode_packet. the header of the returned packet is set whenever
+// the data is long enough to hold one, even if the rest of the packet can not be read. every error wraps
+// err_malformed_packet
+func decode_packet(data []byte) (NetworkPacket, error) {
+	network_packet, req_type, err := decode_packet_prefix(data)
+	if err != nil {
+		return network_packet, err
+	}
+	if limit, ok := max_packet_size(req_type); !ok || len(data) > limit {
+		return network_packet, fmt.Errorf("%w: %d bytes is too long for request type %d", err_malformed_packet, len(data), req_type)
+	}
+	reader := WireReader{Data: data[packet_prefix_size:]}
+	message, err := reader.read_message(req_type)
+	if err == nil {
+		err = reader.finish()
+	}
+	if err != nil {
+		return network_packet, fmt.Errorf("%w: %v", err_malformed_packet, err)
+	}
+	network_packet.Message = message
+	return network_packet, nil
+}
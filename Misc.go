@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"math/big"
 	"os"
 
@@ -98,3 +99,14 @@ func write_to_file(filename string, data string) {
 	defer file.Close()
 	file.Write([]byte(data))
 }
+
+// function append_uint64 appends the big endian encoding of value to buf
+func append_uint64(buf []byte, value uint64) []byte {
+	return binary.BigEndian.AppendUint64(buf, value)
+}
+
+// function append_string appends the length (as a 4 byte big endian integer) followed by the bytes of value to buf
+func append_string(buf []byte, value string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
@@ -1,26 +1,69 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// magic bytes at the start of the header of every packet of this protocol
+var protocol_magic = [4]byte{'B', 'C', 'G', 'O'}
+
+// version of the packet format sent by this peer, packets of any other version are dropped
+const protocol_version = 2
+
+// oldest protocol version of a neighbour this peer completes a handshake with
+const min_protocol_version = 2
+
+// name and version of this peer's software, sent in handshakes so that neighbours can tell implementations apart
+const software_version = "blockchain-golang/0.1.0"
+
+// bits of the features a peer announces in its handshake
+const (
+	feature_header_sync    = iota // serves block headers ahead of their bodies
+	feature_compact_blocks = iota // relays blocks as short transaction ids
+	feature_get_blocks     = iota // sends the blocks missing from a block locator
+	feature_inventory      = iota // announces blocks and transactions by hash and sends them when asked
+)
+
+// set of the features this peer supports, a bit per feature
+const supported_features = uint64(1<<feature_header_sync | 1<<feature_compact_blocks | 1<<feature_get_blocks | 1<<feature_inventory)
+
 // constants for request type ids
 const (
-	req_type_new_connection    = iota
-	req_type_accept_connection = iota
-	req_type_reject_connection = iota
-	req_type_new_transaction   = iota
-	req_type_new_block         = iota
-	req_type_need_block        = iota
-	req_type_need_ip_port_list = iota
-	req_type_ip_port_list      = iota
-	req_type_hello             = iota
-	req_type_hi                = iota
+	req_type_new_connection         = iota
+	req_type_accept_connection      = iota
+	req_type_reject_connection      = iota
+	req_type_new_transaction        = iota
+	req_type_new_block              = iota
+	req_type_need_block             = iota
+	req_type_need_ip_port_list      = iota
+	req_type_ip_port_list           = iota
+	req_type_hello                  = iota
+	req_type_hi                     = iota
+	req_type_submit_transaction     = iota // a transaction sent by a client that is not a peer
+	req_type_get_headers            = iota // only sent to neighbours with feature_header_sync, as are the three below
+	req_type_headers                = iota
+	req_type_get_block_bodies       = iota
+	req_type_block_bodies           = iota
+	req_type_get_blocks             = iota // only sent to neighbours with feature_get_blocks
+	req_type_inv                    = iota // only sent to neighbours with feature_inventory, as is the one below
+	req_type_get_data               = iota
+	req_type_compact_block          = iota // only sent to neighbours with feature_compact_blocks, as are the two below
+	req_type_get_block_transactions = iota
+	req_type_block_transactions     = iota
+	req_type_get_mempool            = iota // a query sent by a client that is not a peer, answered on the same connection
+	req_type_mempool                = iota
 )
 
-// type Address holds a single network address
+// type Address holds a single network address. an Ip of 0 stands for localhost
 type Address struct {
-	Ip   uint32
+	Ip   uint32 // ipv4 address in network byte order
 	Port uint16
 }
 
@@ -28,16 +71,214 @@ func (address Address) to_string() string {
 	if address.Ip == 0 {
 		return fmt.Sprintf("localhost:%d", address.Port)
 	}
-	return fmt.Sprintf("%d:%d", address.Ip, address.Port)
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, address.Ip)
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(address.Port)))
+}
+
+// Address's method has_ip returns true if the given ip address, as a connection reports it, is the ip of the address.
+// localhost matches every loopback address
+func (address Address) has_ip(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if address.Ip == 0 {
+		return parsed.IsLoopback()
+	}
+	ipv4 := parsed.To4()
+	return ipv4 != nil && binary.BigEndian.Uint32(ipv4) == address.Ip
+}
+
+// function parse_address converts a host:port string to an Address. the host must be localhost,
+// an ipv4 address or a name that resolves to an ipv4 address
+func parse_address(value string) (Address, error) {
+	host, port_string, err := net.SplitHostPort(value)
+	if err != nil {
+		return Address{}, err
+	}
+	port, err := strconv.ParseUint(port_string, 10, 16)
+	if err != nil {
+		return Address{}, fmt.Errorf("invalid port %q", port_string)
+	}
+	if host == "" || host == "localhost" {
+		return Address{Port: uint16(port)}, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return Address{}, err
+		}
+		for _, candidate := range ips {
+			if candidate.To4() != nil {
+				ip = candidate
+				break
+			}
+		}
+	}
+	if ip == nil || ip.To4() == nil {
+		return Address{}, fmt.Errorf("%q is not an ipv4 address", host)
+	}
+	return Address{Ip: binary.BigEndian.Uint32(ip.To4()), Port: uint16(port)}, nil
+}
+
+// type PacketHeader tells which protocol, chain and protocol version a packet belongs to
+type PacketHeader struct {
+	Magic            [4]byte
+	Chain_Id         Hash // hash of the genisys node of the sender's chain
+	Protocol_Version uint32
+}
+
+// function create_packet_header returns the header of the packets sent on the chain with the given id
+func create_packet_header(chain_id Hash) PacketHeader {
+	return PacketHeader{Magic: protocol_magic, Chain_Id: chain_id, Protocol_Version: protocol_version}
+}
+
+// ip addresses whose malformed packets are remembered at most, the one heard from least recently is forgotten first
+const max_malformed_sources = 256
+
+// an ip address that sent this many malformed packets has its connections refused for malformed_ban_time, doubling
+// with every further malformed packet up to max_malformed_ban_time. an address is forgotten once it sent no malformed
+// packet for max_malformed_ban_time
+const (
+	malformed_ban_threshold = 3
+	malformed_ban_time      = 30 * time.Second
+	max_malformed_ban_time  = time.Hour
+)
+
+// Type MalformedSource holds the malformed packets received from a single ip address
+type MalformedSource struct {
+	Count   uint64
+	Last_At time.Time // time the last one was received
+}
+
+// MalformedSource's method banned_until returns the time until which connections from the source are refused, the zero
+// time if they are not
+func (source MalformedSource) banned_until() time.Time {
+	if source.Count < malformed_ban_threshold {
+		return time.Time{}
+	}
+	return source.Last_At.Add(min(malformed_ban_time<<min(source.Count-malformed_ban_threshold, 16), max_malformed_ban_time))
+}
+
+// Type PacketCounters counts the packets a peer dropped for a header that does not match its own or for breaking the
+// wire format. the counters are updated by the goroutines receiving packets
+type PacketCounters struct {
+	Bad_Magic       atomic.Uint64
+	Wrong_Chain     atomic.Uint64
+	Wrong_Version   atomic.Uint64
+	Malformed_Total atomic.Uint64
+	Malformed       map[string]MalformedSource // {remote ip: malformed packets received from it}
+	mutex           sync.Mutex                 // guards Malformed
+}
+
+// PacketCounters's method count checks the header of a received packet against the expected header. returns false
+// and counts the packet if it has to be dropped
+func (counters *PacketCounters) count(header PacketHeader, expected PacketHeader) bool {
+	switch {
+	case header.Magic != expected.Magic:
+		counters.Bad_Magic.Add(1)
+	case header.Chain_Id != expected.Chain_Id:
+		counters.Wrong_Chain.Add(1)
+	case header.Protocol_Version != expected.Protocol_Version:
+		counters.Wrong_Version.Add(1)
+	default:
+		return true
+	}
+	return false
+}
+
+// PacketCounters's method count_malformed counts a malformed packet received from the given remote ip address. the
+// addresses not heard from for max_malformed_ban_time are forgotten, and the least recent one if max_malformed_sources
+// are remembered
+func (counters *PacketCounters) count_malformed(remote_ip string) {
+	counters.Malformed_Total.Add(1)
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	if counters.Malformed == nil {
+		counters.Malformed = make(map[string]MalformedSource)
+	}
+	now := time.Now()
+	if _, known := counters.Malformed[remote_ip]; !known && len(counters.Malformed) >= max_malformed_sources {
+		least_recent := ""
+		for ip, source := range counters.Malformed {
+			if now.Sub(source.Last_At) > max_malformed_ban_time {
+				delete(counters.Malformed, ip)
+			} else if least_recent == "" || source.Last_At.Before(counters.Malformed[least_recent].Last_At) {
+				least_recent = ip
+			}
+		}
+		if len(counters.Malformed) >= max_malformed_sources {
+			delete(counters.Malformed, least_recent)
+		}
+	}
+	source := counters.Malformed[remote_ip]
+	counters.Malformed[remote_ip] = MalformedSource{Count: source.Count + 1, Last_At: now}
+}
+
+// PacketCounters's method is_banned returns true if connections from the given ip address are refused for the
+// malformed packets it sent
+func (counters *PacketCounters) is_banned(remote_ip string) bool {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	return time.Now().Before(counters.Malformed[remote_ip].banned_until())
+}
+
+// PacketCounters's method total returns the number of dropped packets
+func (counters *PacketCounters) total() uint64 {
+	return counters.Bad_Magic.Load() + counters.Wrong_Chain.Load() + counters.Wrong_Version.Load() + counters.Malformed_Total.Load()
+}
+
+func (counters *PacketCounters) to_string() string {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	remotes := get_map_keys(counters.Malformed)
+	sort.Strings(remotes)
+	malformed := make([]string, 0, len(remotes))
+	for _, remote := range remotes {
+		source := counters.Malformed[remote]
+		if time.Now().Before(source.banned_until()) {
+			malformed = append(malformed, fmt.Sprintf("%s: %d (banned)", remote, source.Count))
+		} else {
+			malformed = append(malformed, fmt.Sprintf("%s: %d", remote, source.Count))
+		}
+	}
+	return fmt.Sprintf("bad magic %d, wrong chain %d, wrong version %d, malformed %d %v", counters.Bad_Magic.Load(), counters.Wrong_Chain.Load(), counters.Wrong_Version.Load(), counters.Malformed_Total.Load(), malformed)
+}
+
+// Type Handshake holds what a peer tells a new neighbour about itself when connecting to it or accepting it
+type Handshake struct {
+	Protocol_Version uint32
+	Software_Version string
+	Features         uint64 // a bit per supported feature
+	Height           uint64 // height of the tip of the peer's best chain
+	Tip              Hash
+	Node_Id          Hash // random id the peer picks on start, tells a peer that it connected to itself
+}
+
+// Handshake's method check returns an error if a peer with the given node id can not take the sender of the
+// handshake as a neighbour
+func (handshake Handshake) check(node_id Hash) error {
+	if handshake.Protocol_Version < min_protocol_version {
+		return fmt.Errorf("protocol version %d is older than %d", handshake.Protocol_Version, min_protocol_version)
+	}
+	if handshake.Node_Id == node_id {
+		return fmt.Errorf("connected to itself")
+	}
+	return nil
+}
+
+// Handshake's method has_feature returns true if the sender of the handshake supports the given feature
+func (handshake Handshake) has_feature(feature int) bool {
+	return bit_is_set(handshake.Features, feature)
 }
 
 // type NetworkPacket holds a single network packet
 type NetworkPacket struct {
-	Req_Type     int
-	Req_From     Address // ip and port number
-	Transaction  Transaction
-	Block        Block
-	Merkel_Tree  MerkelTree
-	Ip_Port_List []Address
-	Block_Hash   Hash
+	Header   PacketHeader // must match the receiver's header or the packet is dropped
+	Req_From Address      // ip and port number
+	Message  Message      // one of the message types of Message.go, which gives the request type
+
+	connection *Connection // connection the packet was received on, nil for a packet that is sent
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"encoding/gob"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"sort"
 	"time"
 )
 
@@ -17,8 +19,33 @@ const (
 	report_type_received_block       = iota
 	report_type_blockchain_updated   = iota
 	report_type_entire_blockchain    = iota
+	report_type_reorg                = iota
+	report_type_rejected_reorg       = iota
+	report_type_dropped_packets      = iota
+	report_type_handshake            = iota
+	report_type_sync                 = iota
+	report_type_compact_blocks       = iota
+	report_type_mempool              = iota
 )
 
+// map of report names (used on the command line and in logs) to their report types
+var report_type_names = map[string]int{
+	"connections":          report_type_connections,
+	"transaction_created":  report_type_transaction_created,
+	"block_mined":          report_type_block_mined,
+	"received_transaction": report_type_received_transaction,
+	"received_block":       report_type_received_block,
+	"blockchain_updated":   report_type_blockchain_updated,
+	"entire_blockchain":    report_type_entire_blockchain,
+	"reorg":                report_type_reorg,
+	"rejected_reorg":       report_type_rejected_reorg,
+	"dropped_packets":      report_type_dropped_packets,
+	"handshake":            report_type_handshake,
+	"sync":                 report_type_sync,
+	"compact_blocks":       report_type_compact_blocks,
+	"mempool":              report_type_mempool,
+}
+
 // Type ReportToMain holds the information a peer sends to its calling function
 type ReportToMain struct {
 	Source_Address Address
@@ -29,7 +56,6 @@ type ReportToMain struct {
 // Type PeerConfig holds the settings of a peer passed to peer_main function
 type PeerConfig struct {
 	Self_Address          Address
-	Trailing_Zeros        int
 	Is_Bootstrap          bool
 	Is_Miner              bool
 	Is_Transaction_Maker  bool
@@ -39,30 +65,51 @@ type PeerConfig struct {
 	Die_After             int64
 	Up_Channel            chan ReportToMain
 	Is_Bad_Node           bool
+	Data_Dir              string          // if not empty, accepted blocks are stored here and reloaded when the peer restarts
+	Quit_Channel          <-chan struct{} // if not nil, the peer leaves the network once this channel is closed
+	Chain_Params          ChainParams
+	Private_Key           ed25519.PrivateKey // key the peer signs its transactions with, a random key is used if nil
+	Side_Branch_Depth     uint64             // side branches that forked more than this many blocks below the tip are dropped
+	Mempool_Limits        MempoolLimits
 }
 
 // type Peer holds all the information of a single peer
 type Peer struct {
 	Blockchain           Blockchain
-	Transactions         map[Hash]Transaction
+	Ledger               Ledger   // state of the accounts after the blockchain's best chain
+	Mempool              *Mempool // transactions waiting to be included in a block
 	Block_Groups         map[Hash][]Block
-	Blocks               map[Hash]int64 // {Block: receive time}
+	Grouped_Blocks       map[Hash]bool    // hashes of the blocks held in block groups
+	Blocks               map[Hash]int64   // {Block: receive time}
+	Block_Sources        map[Hash]Address // {previous block hash of a block group: neighbour that sent its last block}
 	Merkel_Trees         map[Hash]MerkelTree
 	My_Address           Address
 	Is_Miner             bool
 	Is_Transaction_Maker bool
 	Is_Bootstrap         bool
-	Network_Members      map[Address]int64 // {address: last contacted}
-	Neighbours           map[Address]int64 // {address: last contacted}
+	Network_Members      map[Address]int64     // {address: last contacted}
+	Neighbours           map[Address]int64     // {address: last contacted}
+	Neighbour_Handshakes map[Address]Handshake // {address: handshake the neighbour sent when connecting}
+	Node_Id              Hash                  // random id sent in handshakes
 	Bootstrap_Address    Address
 	Max_Neighbours       int
+	Store                *BlockStore                 // nil if the peer does not keep its blocks on disk
+	Header               PacketHeader                // header of every packet the peer sends or accepts
+	Dropped_Packets      *PacketCounters             // packets dropped for a header that does not match the peer's header or being malformed
+	Connections          *ConnectionPool             // long lived connections to the peers the peer talks to
+	Sync                 *HeaderSync                 // nil if the peer is not synchronizing its chain with its neighbours
+	Known_Inventory      map[Address]*KnownInventory // {neighbour: hashes of the items it is known to have}
+	Inventory_Requests   map[Hash]int64              // {item hash: time it was asked of a neighbour}
+	Partial_Blocks       map[Hash]*PartialBlock      // {block hash: compact block waiting for its missing transactions}
+	Mempool_Replies      map[*Connection]int64       // {connection: time the whole pool was last listed on it}
+	Compact_Stats        CompactBlockStats
 	pc                   PeerConfig
 }
 
 // function peer_main creates and simulates a peer according to the given input as configuration
 func peer_main(pc PeerConfig) {
 
-	transaction_creation_channel := make(chan Transaction)
+	transaction_creation_channel := make(chan struct{})
 	block_mine_channel := make(chan struct {
 		Block
 		MerkelTree
@@ -71,21 +118,48 @@ func peer_main(pc PeerConfig) {
 
 	init_time := time.Now().Unix()
 	is_mining := false
+	template, template_version, template_tip := []Transaction(nil), uint64(0), Hash{} // transactions of the next block to mine and the pool version and tip they were selected for
 	last_neighbour_req := int64(0)
 	neighbour_req_timeout := int64(10)
 	last_hello := make(map[Address]int64)
 	timeout := int64(15) // network members need to communicate once every timeout seconds to stay in network
 	last_block_request := int64(0)
 
-	peer := Peer{Blockchain: create_blockchain(), My_Address: pc.Self_Address, Is_Bootstrap: pc.Is_Bootstrap, Is_Miner: pc.Is_Miner, Is_Transaction_Maker: pc.Is_Transaction_Maker, Bootstrap_Address: pc.Bootstrap_Address, Max_Neighbours: pc.Max_Neighbours, Network_Members: make(map[Address]int64), Neighbours: make(map[Address]int64), Transactions: make(map[Hash]Transaction), Block_Groups: make(map[Hash][]Block), Blocks: make(map[Hash]int64), Merkel_Trees: make(map[Hash]MerkelTree), pc: pc}
+	if pc.Private_Key == nil {
+		pc.Private_Key = generate_key()
+	}
+
+	peer := Peer{Blockchain: create_blockchain(pc.Chain_Params), My_Address: pc.Self_Address, Is_Bootstrap: pc.Is_Bootstrap, Is_Miner: pc.Is_Miner, Is_Transaction_Maker: pc.Is_Transaction_Maker, Bootstrap_Address: pc.Bootstrap_Address, Max_Neighbours: pc.Max_Neighbours, Network_Members: make(map[Address]int64), Neighbours: make(map[Address]int64), Mempool: create_mempool(pc.Mempool_Limits), Block_Groups: make(map[Hash][]Block), Grouped_Blocks: make(map[Hash]bool), Blocks: make(map[Hash]int64), Block_Sources: make(map[Hash]Address), Merkel_Trees: make(map[Hash]MerkelTree), pc: pc}
+	peer.Ledger = create_ledger(pc.Chain_Params)
+	peer.Header, peer.Dropped_Packets = create_packet_header(peer.Blockchain.Chain_Id), &PacketCounters{}
+	peer.Neighbour_Handshakes, peer.Node_Id = make(map[Address]Handshake), random_hash()
+	peer.Known_Inventory, peer.Inventory_Requests = make(map[Address]*KnownInventory), make(map[Hash]int64)
+	peer.Partial_Blocks, peer.Mempool_Replies = make(map[Hash]*PartialBlock), make(map[*Connection]int64)
+
+	if pc.Data_Dir != "" {
+		store, err := open_block_store(pc.Data_Dir, false)
+		if err != nil {
+			fmt.Printf("Port %d failed to open block store: %v\n", peer.My_Address.Port, err)
+			return
+		}
+		defer store.close()
+		peer.Store = store
+		peer.__load_stored_blocks()
+	}
 
-	go __listen(network_packet_channel, peer.My_Address) // start listening
+	peer.Connections = create_connection_pool(peer.My_Address, peer.Header, peer.Dropped_Packets, network_packet_channel)
+	peer.Connections.Min_Trailing_Zeros = pc.Chain_Params.Min_Trailing_Zeros
+	if err := peer.Connections.listen(); err != nil { // start listening
+		fmt.Println("Error starting listening", err)
+		return
+	}
+	defer peer.Connections.close()
 
 	if pc.Is_Transaction_Maker {
 		go __transaction_creator(transaction_creation_channel)
 	}
 
-	last_print := time.Now().Unix()
+	last_print, last_dropped, last_compact, last_mempool := time.Now().Unix(), uint64(0), uint64(0), MempoolStats{}
 	for {
 		if time.Now().Unix()-last_print > 5 {
 			last_print = time.Now().Unix()
@@ -94,7 +168,40 @@ func peer_main(pc PeerConfig) {
 			pc.Up_Channel <- ReportToMain{
 				Source_Address: peer.My_Address,
 				Report_Type:    report_type_connections,
-				Report_Body:    fmt.Sprintf("%v", peer.Neighbours)}
+				Report_Body:    peer.__neighbours_string()}
+
+			// report the packets dropped for belonging to another network or being malformed if more were dropped since
+			// the last report
+			if dropped := peer.Dropped_Packets.total(); dropped != last_dropped {
+				last_dropped = dropped
+				pc.Up_Channel <- ReportToMain{
+					Source_Address: peer.My_Address,
+					Report_Type:    report_type_dropped_packets,
+					Report_Body:    peer.Dropped_Packets.to_string()}
+			}
+
+			// report the compact blocks received and the bandwidth they saved if more were received since the last report
+			if compact := peer.Compact_Stats.Blocks + peer.Compact_Stats.Failed; compact != last_compact {
+				last_compact = compact
+				pc.Up_Channel <- ReportToMain{
+					Source_Address: peer.My_Address,
+					Report_Type:    report_type_compact_blocks,
+					Report_Body:    peer.Compact_Stats.to_string()}
+			}
+
+			peer.__prune_inventory_requests()
+			peer.__prune_partial_blocks()
+			peer.__prune_mempool_replies()
+			peer.Mempool.expire()
+
+			// report the state of the mempool if it changed since the last report
+			if mempool := peer.Mempool.stats(); mempool != last_mempool {
+				last_mempool = mempool
+				pc.Up_Channel <- ReportToMain{
+					Source_Address: peer.My_Address,
+					Report_Type:    report_type_mempool,
+					Report_Body:    mempool.to_string()}
+			}
 		}
 
 		// check if any node has left network
@@ -118,8 +225,7 @@ func peer_main(pc PeerConfig) {
 				ip_port_list := get_map_keys(peer.Network_Members)
 				peer.__try_add_neighbours(ip_port_list)
 			} else {
-				req_packet := NetworkPacket{Req_Type: req_type_need_ip_port_list, Req_From: peer.My_Address}
-				go __send_request(req_packet, pc.Bootstrap_Address)
+				peer.__send(NeedIpPortListMessage{}, pc.Bootstrap_Address)
 			}
 			last_neighbour_req = time.Now().Unix()
 		}
@@ -127,7 +233,7 @@ func peer_main(pc PeerConfig) {
 		// check if any neighbour should be removed due to no contact for some time
 		for neighbour, last_contact := range peer.Neighbours {
 			if time.Now().Unix()-last_contact > timeout {
-				delete(peer.Neighbours, neighbour)
+				peer.__remove_neighbour(neighbour)
 			} else if time.Now().Unix()-last_contact > timeout/2 {
 				peer.__do_hello(&last_hello, timeout, neighbour)
 			}
@@ -138,10 +244,25 @@ func peer_main(pc PeerConfig) {
 			peer.__drop_random_neighbours(len(peer.Neighbours) - peer.Max_Neighbours)
 		}
 
-		// start mining if peer is miner and transaction count sufficient
-		if !is_mining && peer.Is_Miner && len(peer.Transactions) >= pc.Transaction_Per_Block {
-			go __mine_new_block(block_mine_channel, get_map_values(peer.Transactions)[:pc.Transaction_Per_Block], peer.Blockchain.get_last_hash(), pc.Trailing_Zeros)
-			is_mining = true
+		// start mining if peer is miner and enough transactions can be applied to the ledger, the ones paying the most
+		// per byte first. the block's coinbase pays the block reward and the fees of the transactions to the peer. the
+		// transactions are only selected again once the pool or the tip changed
+		if !is_mining && peer.Is_Miner && peer.Mempool.count() >= pc.Transaction_Per_Block {
+			if template_version != peer.Mempool.Version || template_tip != peer.Blockchain.get_last_hash() {
+				template = peer.Mempool.select_transactions(peer.Ledger, pc.Transaction_Per_Block)
+				template_version, template_tip = peer.Mempool.Version, peer.Blockchain.get_last_hash()
+			}
+			if selected := template; len(selected) >= pc.Transaction_Per_Block {
+				prev_hash, fees := peer.Blockchain.get_last_hash(), uint64(0)
+				for _, transaction := range selected {
+					fees += transaction.Fee
+				}
+				coinbase := create_coinbase(peer.Ledger.Mode, peer.__account(), pc.Chain_Params.Block_Reward+fees, prev_hash)
+				height := peer.Blockchain.Blocks[prev_hash].Height + 1 // the zero hash before the genisys node has height 0
+				timestamp := max(time.Now().Unix(), peer.Blockchain.median_time_past(prev_hash)+1)
+				go __mine_new_block(block_mine_channel, append([]Transaction{coinbase}, selected...), prev_hash, height, timestamp, peer.Blockchain.next_trailing_zeros(prev_hash))
+				is_mining = true
+			}
 		}
 
 		// check for incoming network requests
@@ -153,22 +274,27 @@ func peer_main(pc PeerConfig) {
 			peer.__handle_network_packet(&packet)
 		}
 
-		// check if any transaction has been created
+		// check if any transaction should be created
 		for {
-			transaction, ok := CollectChanOne[Transaction](transaction_creation_channel)
+			_, ok := CollectChanOne(transaction_creation_channel)
 			if !ok {
 				break
 			}
+			transaction, ok := peer.__create_transaction()
+			if !ok {
+				continue
+			}
 
 			// report that a new transaction was created
 			pc.Up_Channel <- ReportToMain{
 				Source_Address: peer.My_Address,
 				Report_Type:    report_type_transaction_created,
-				Report_Body:    fmt.Sprintf("%v", transaction.Value),
+				Report_Body:    transaction.to_string(),
 			}
 
-			peer.Transactions[transaction.hashed()] = transaction
-			peer.__propagate_transaction(transaction)
+			if _, ok := peer.Mempool.add(transaction); ok {
+				peer.__propagate_transaction(transaction)
+			}
 		}
 
 		// check if a block has been mined
@@ -196,6 +322,7 @@ func peer_main(pc PeerConfig) {
 		}
 
 		peer.__evaluate_block_groups(&last_block_request) // received blocks always make a group which is then either added or not added to blockchain
+		peer.__evaluate_sync()
 
 		// sleep to reduce load on cpu
 		time.Sleep(time.Microsecond * 100)
@@ -206,42 +333,120 @@ func peer_main(pc PeerConfig) {
 			return
 		}
 
+		select {
+		case <-pc.Quit_Channel: // a nil quit channel is never ready
+			fmt.Printf("Port %d left the network!\n", peer.My_Address.Port)
+			return
+		default:
+		}
+
 	}
 }
 
+// Peer's method __neighbours_string returns the sorted addresses of the peer's neighbours as a single string
+func (peer *Peer) __neighbours_string() string {
+	neighbours := make([]string, 0, len(peer.Neighbours))
+	for neighbour := range peer.Neighbours {
+		neighbours = append(neighbours, neighbour.to_string())
+	}
+	sort.Strings(neighbours)
+	return fmt.Sprintf("%v", neighbours)
+}
+
 // Peer's method __drop_random_neighbours drops given number of random neighbours from the peer's neighbour list
 func (peer *Peer) __drop_random_neighbours(count int) {
 	ip_port_list := get_map_keys(peer.Neighbours)
 	indexes := rand.Perm(len(ip_port_list))
 	for i := 0; i < count; i++ {
-		delete(peer.Neighbours, ip_port_list[indexes[i]])
+		peer.__remove_neighbour(ip_port_list[indexes[i]])
 	}
 }
 
-// Peer's method __propagate_transaction sends the provided transaction to every neighbour of the peer
-func (peer *Peer) __propagate_transaction(transaction Transaction) {
-	packet_to_send := NetworkPacket{Req_Type: req_type_new_transaction, Req_From: peer.My_Address, Transaction: transaction}
-	for neighbour := range peer.Neighbours {
-		go __send_request(packet_to_send, neighbour)
+// Peer's method __remove_neighbour removes the given neighbour along with its handshake and known inventory and closes
+// the connection to it
+func (peer *Peer) __remove_neighbour(neighbour Address) {
+	delete(peer.Neighbours, neighbour)
+	delete(peer.Neighbour_Handshakes, neighbour)
+	delete(peer.Known_Inventory, neighbour)
+	peer.Connections.disconnect(neighbour)
+}
+
+// Peer's method __handshake returns the handshake the peer sends when connecting to a neighbour or accepting one
+func (peer *Peer) __handshake() Handshake {
+	tip := peer.Blockchain.get_last_hash()
+	return Handshake{
+		Protocol_Version: protocol_version,
+		Software_Version: software_version,
+		Features:         supported_features,
+		Height:           peer.Blockchain.Blocks[tip].Height,
+		Tip:              tip,
+		Node_Id:          peer.Node_Id,
 	}
 }
 
-// Peer's method __propagate_block sends the provided block to every  neighbour of the peer
-func (peer *Peer) __propagate_block(block Block, merkel_tree MerkelTree) {
-	packet_to_send := NetworkPacket{Req_Type: req_type_new_block, Req_From: peer.My_Address, Block: block, Merkel_Tree: merkel_tree}
-	for neighbour := range peer.Neighbours {
-		go __send_request(packet_to_send, neighbour)
+// Peer's method __complete_handshake checks the handshake of a peer that is connecting or accepted the peer's
+// connection. if the peer can be a neighbour its handshake is kept and true is returned. when the new neighbour's
+// best chain is ahead the peer synchronizes with it right away, by a headers-first synchronization if the neighbour
+// serves headers and by requesting the blocks up to its tip otherwise
+func (peer *Peer) __complete_handshake(packet *NetworkPacket, handshake Handshake) bool {
+	neighbour := packet.Req_From
+	err := handshake.check(peer.Node_Id)
+	if err == nil && !peer.Connections.bind(*packet) { // send to the new neighbour on the connection it completed the handshake on
+		err = errors.New("handshake came in on a connection from another address")
+	}
+	if err != nil {
+		peer.pc.Up_Channel <- ReportToMain{
+			Source_Address: peer.My_Address,
+			Report_Type:    report_type_handshake,
+			Report_Body:    fmt.Sprintf("refused %v: %v", neighbour.to_string(), err),
+		}
+		return false
+	}
+	peer.Neighbours[neighbour] = time.Now().Unix()
+	peer.Neighbour_Handshakes[neighbour] = handshake
+	peer.pc.Up_Channel <- ReportToMain{
+		Source_Address: peer.My_Address,
+		Report_Type:    report_type_handshake,
+		Report_Body:    fmt.Sprintf("%v runs %s (protocol %d, features %b) at height %d", neighbour.to_string(), handshake.Software_Version, handshake.Protocol_Version, handshake.Features, handshake.Height),
+	}
+
+	tip := peer.Blockchain.Blocks[peer.Blockchain.get_last_hash()]
+	if _, known := peer.Blockchain.Blocks[handshake.Tip]; !known && handshake.Height > tip.Height {
+		if handshake.has_feature(feature_header_sync) {
+			peer.__start_sync(neighbour)
+		} else {
+			peer.__request_blocks(handshake.Tip, neighbour)
+		}
 	}
+	return true
+}
+
+// Peer's method __propagate_transaction announces the provided transaction to every neighbour of the peer that does
+// not have it yet
+func (peer *Peer) __propagate_transaction(transaction Transaction) {
+	peer.__announce(InvItem{Type: inv_type_transaction, Hash: transaction.hashed()}, NewTransactionMessage{Transaction: transaction})
 }
 
-// Peer's method __extend_blockchain extends blockchain with the given blocks and merkel trees.
-// if the blockchain accepts the new blocks, return true else return false
+// Peer's method __send queues a packet holding the given message on the peer's connection to the target
+func (peer *Peer) __send(message Message, target Address) {
+	peer.Connections.send(NetworkPacket{Req_From: peer.My_Address, Message: message}, target)
+}
+
+// Peer's method __propagate_block announces the provided block to every neighbour of the peer that does not have it yet
+func (peer *Peer) __propagate_block(block Block, merkel_tree MerkelTree) {
+	peer.__announce(InvItem{Type: inv_type_block, Hash: block.hashed()}, NewBlockMessage{Block: block, Merkel_Tree: merkel_tree})
+}
+
+// Peer's method __extend_blockchain adds the given blocks and merkel trees to the block tree. blocks that do not make
+// a new best chain are kept as a side branch. when the best chain changes the ledger is reorganized, the transactions
+// of the disconnected blocks are returned to the peer's transactions and a reorg is reported if any block was
+// disconnected. returns true if the best chain changed
 func (peer *Peer) __extend_blockchain(blocks []Block, merkel_trees []MerkelTree) bool {
 	if len(blocks) != len(merkel_trees) {
 		return false
 	}
 	for i := 0; i < len(blocks); i++ {
-		if blocks[i].Merkel_Root != merkel_trees[i].hashed() || !blocks[i].is_valid() || !merkel_trees[i].is_valid() { // checks that the blocks and merkel trees are valid and compatible
+		if blocks[i].Merkel_Root != merkel_trees[i].hashed() || !blocks[i].is_valid() || !merkel_trees[i].is_valid() || !merkel_trees[i].has_valid_signatures() { // checks that the blocks and merkel trees are valid and compatible
 			return false
 		}
 	}
@@ -249,27 +454,74 @@ func (peer *Peer) __extend_blockchain(blocks []Block, merkel_trees []MerkelTree)
 	if already_in {
 		return false
 	}
-	all_transactions := make(map[Hash]bool)
+	old_tip, added := peer.Blockchain.get_last_hash(), make([]Block, 0, len(blocks))
 	for i := 0; i < len(blocks); i++ {
+		if _, known := peer.Blockchain.Blocks[blocks[i].hashed()]; known {
+			continue
+		}
+		err := peer.Blockchain.check_block_context(blocks[i]) // blocks come in order so the previous block is already added
+		if err == nil {
+			err = peer.Blockchain.check_finality(blocks[i])
+		}
+		if err != nil {
+			if errors.Is(err, err_checkpoint_conflict) || errors.Is(err, err_beyond_finality) {
+				// report that a branch trying to reorganize final blocks was refused
+				peer.pc.Up_Channel <- ReportToMain{
+					Source_Address: peer.My_Address,
+					Report_Type:    report_type_rejected_reorg,
+					Report_Body:    fmt.Sprintf("block %s: %v", blocks[i].hashed().to_string(), err),
+				}
+			}
+			peer.Blockchain.remove_added_blocks(added, old_tip)
+			return false
+		}
 		peer.Blockchain.add_block(blocks[i])
 		peer.Blockchain.add_merkel_tree(merkel_trees[i])
-		for transaction_hash := range merkel_trees[i].Transactions {
-			all_transactions[transaction_hash] = true
-		}
+		added = append(added, blocks[i])
 	}
-	peer.Blockchain.remove_short_chains()
-	_, added := peer.Blockchain.Blocks[blocks[len(blocks)-1].hashed()]
-	if !added {
+	new_tip := peer.Blockchain.get_last_hash()
+	if new_tip == old_tip {
+		// the blocks extend a side branch that has less work than the best chain
+		peer.__store_blocks(blocks, merkel_trees)
+		peer.Blockchain.prune_side_branches(peer.pc.Side_Branch_Depth)
 		return false
 	}
-	pruned_transactions := make(map[Hash]Transaction)
-	for _, transaction := range peer.Transactions {
-		_, ok := all_transactions[transaction.hashed()]
-		if !ok {
-			pruned_transactions[transaction.hashed()] = transaction
+
+	// move the ledger to the new best chain. blocks of the old chain after the fork are rolled back first
+	fork := peer.Blockchain.find_fork(old_tip, new_tip)
+	disconnected, connected := peer.Blockchain.blocks_after(fork, old_tip), peer.Blockchain.blocks_after(fork, new_tip)
+	if err := peer.Ledger.reorganize(disconnected, connected, peer.Blockchain.Merkel_Trees); err != nil {
+		// the new best chain holds a transaction that can not be applied (overdraft, replayed nonce, double spend, etc)
+		peer.Blockchain.remove_added_blocks(added, old_tip)
+		return false
+	}
+	peer.__prune_undo()
+
+	included := make(map[Hash]bool)
+	for _, block := range connected {
+		for transaction_hash := range peer.Blockchain.Merkel_Trees[block.Merkel_Root].Transactions {
+			included[transaction_hash] = true
+		}
+	}
+	for _, block := range disconnected {
+		for transaction_hash, transaction := range peer.Blockchain.Merkel_Trees[block.Merkel_Root].Transactions {
+			if !transaction.Is_Coinbase && !included[transaction_hash] && peer.__is_acceptable_transaction(transaction) {
+				peer.Mempool.add(transaction)
+			}
+		}
+	}
+	peer.__prune_transactions(included)
+	peer.__store_blocks(blocks, merkel_trees)
+	peer.Blockchain.prune_side_branches(peer.pc.Side_Branch_Depth)
+
+	if len(disconnected) > 0 {
+		// report that blocks of the old best chain were disconnected
+		peer.pc.Up_Channel <- ReportToMain{
+			Source_Address: peer.My_Address,
+			Report_Type:    report_type_reorg,
+			Report_Body:    fmt.Sprintf("depth %d from %s to %s", len(disconnected), old_tip.to_string(), new_tip.to_string()),
 		}
 	}
-	peer.Transactions = pruned_transactions
 
 	// report a change in blockchain to main
 	peer.pc.Up_Channel <- ReportToMain{
@@ -282,12 +534,218 @@ func (peer *Peer) __extend_blockchain(blocks []Block, merkel_trees []MerkelTree)
 	peer.pc.Up_Channel <- ReportToMain{
 		Source_Address: peer.My_Address,
 		Report_Type:    report_type_entire_blockchain,
-		Report_Body:    peer.Blockchain.pretty_print(),
+		Report_Body:    peer.Blockchain.print_best_chain(true),
 	}
 
 	return true
 }
 
+// Peer's method __store_blocks writes the given blocks and merkel trees to the peer's block store if it has one
+func (peer *Peer) __store_blocks(blocks []Block, merkel_trees []MerkelTree) {
+	if peer.Store == nil {
+		return
+	}
+	for i := 0; i < len(blocks); i++ {
+		if err := peer.Store.put_block(blocks[i], merkel_trees[i]); err != nil {
+			fmt.Printf("Port %d failed to store block: %v\n", peer.My_Address.Port, err)
+		}
+	}
+}
+
+// Peer's method __load_stored_blocks rebuilds the peer's block tree and ledger from the blocks in its store. if a
+// block of the best stored chain can not be applied to the ledger only the blocks before it are kept, the peer then
+// syncs the rest of the chain from its neighbours as usual
+func (peer *Peer) __load_stored_blocks() {
+	stored, rejected, err := peer.Store.load_blockchain(peer.pc.Chain_Params)
+	if err != nil {
+		fmt.Printf("Port %d failed to load stored blocks: %v\n", peer.My_Address.Port, err)
+	}
+	if rejected > 0 {
+		fmt.Printf("Port %d dropped %d stored blocks that break the chain rules\n", peer.My_Address.Port, rejected)
+	}
+	blockchain, ledger := create_blockchain(peer.pc.Chain_Params), create_ledger(peer.pc.Chain_Params)
+	best_chain := stored.best_chain()
+	for _, block := range best_chain[1:] { // the genisys node is already in the new blockchain
+		merkel_tree := stored.Merkel_Trees[block.Merkel_Root]
+		if err := ledger.connect_block(block.hashed(), merkel_tree); err != nil {
+			fmt.Printf("Port %d dropped stored block %s: %v\n", peer.My_Address.Port, block.hashed().to_string(), err)
+			break
+		}
+		blockchain.add_block(block)
+		blockchain.add_merkel_tree(merkel_tree)
+	}
+	if len(blockchain.Blocks) == len(best_chain) {
+		blockchain = stored // every block of the best chain connected, keep the side branches as well
+		blockchain.prune_side_branches(peer.pc.Side_Branch_Depth)
+	}
+	peer.Blockchain, peer.Ledger = blockchain, ledger
+	peer.__prune_undo()
+	if len(blockchain.Blocks) > 1 {
+		fmt.Printf("Port %d loaded %d stored blocks\n", peer.My_Address.Port, len(blockchain.Blocks)-1)
+	}
+}
+
+// Peer's method __prune_undo drops the undo data of the blocks of the ledger that are more than the finality depth
+// below the tip, since blocks that deep are never disconnected
+func (peer *Peer) __prune_undo() {
+	if finality_depth := peer.pc.Chain_Params.Finality_Depth; finality_depth > 0 && peer.Ledger.Height > finality_depth {
+		peer.Ledger.prune_undo(peer.Ledger.Height - finality_depth)
+	}
+}
+
+// Peer's method __account returns the account the peer sends transactions from and receives them to
+func (peer *Peer) __account() string {
+	return address_from_key(peer.pc.Private_Key)
+}
+
+// Peer's method __is_acceptable_transaction checks whether a transaction may enter the peer's list of transactions.
+// the transaction may still depend on other pending transactions so the balance is only checked when mining.
+// in the utxo ledger mode a transaction spending an output that a pending transaction already spends is rejected
+func (peer *Peer) __is_acceptable_transaction(transaction Transaction) bool {
+	if !transaction.Not_Null || !transaction.has_valid_signature() {
+		return false
+	}
+	if peer.Ledger.Mode != ledger_mode_utxo {
+		return transaction.To != "" && !transaction.is_utxo() && transaction.Nonce >= peer.Ledger.get_account(transaction.From).Nonce
+	}
+	if len(transaction.Inputs) == 0 || len(transaction.Outputs) == 0 {
+		return false
+	}
+	for _, input := range transaction.Inputs {
+		if peer.Mempool.spends(input) {
+			return false
+		}
+		if _, unspent := peer.Ledger.Utxos[input]; !unspent && !peer.Mempool.creates(input) {
+			return false
+		}
+	}
+	return true
+}
+
+// seconds a connection waits before the whole pool is listed on it again, listing it sorts every pending transaction
+const mempool_reply_interval = 5
+
+// Peer's method __serve_mempool answers a get mempool request on the connection it came in on with the pool's stats
+// and its transactions sent from the given address, or all of them for an empty address. as many transactions as fit
+// in max_mempool_reply_size bytes are sent, the ones paying the highest fee per byte first. a request for the whole
+// pool within mempool_reply_interval seconds of the last one answered on the same connection is ignored
+func (peer *Peer) __serve_mempool(request NetworkPacket, address string) {
+	var transactions []Transaction
+	if address != "" {
+		transactions = peer.Mempool.pending_from(address)
+	} else {
+		now := time.Now().Unix()
+		if last, found := peer.Mempool_Replies[request.connection]; found && now-last < mempool_reply_interval {
+			return
+		}
+		peer.Mempool_Replies[request.connection] = now
+		transactions = peer.Mempool.pending()
+	}
+	reply, size := MempoolMessage{Stats: peer.Mempool.stats(), Transactions: make([]Transaction, 0)}, 0
+	for _, transaction := range transactions {
+		if size += len(transaction.encode_wire()); size > max_mempool_reply_size {
+			break
+		}
+		reply.Transactions = append(reply.Transactions, transaction)
+	}
+	peer.Connections.reply(request, reply)
+}
+
+// Peer's method __prune_mempool_replies forgets the connections the whole pool may be listed on again
+func (peer *Peer) __prune_mempool_replies() {
+	now := time.Now().Unix()
+	for connection, replied_at := range peer.Mempool_Replies {
+		if now-replied_at >= mempool_reply_interval {
+			delete(peer.Mempool_Replies, connection)
+		}
+	}
+}
+
+// Peer's method __prune_transactions removes the transactions that were included in the blockchain and the
+// ones that can never be applied to the current ledger (an older nonce or an input that was spent by a block)
+func (peer *Peer) __prune_transactions(included map[Hash]bool) {
+	for transaction_hash, entry := range peer.Mempool.Entries {
+		if included[transaction_hash] || entry.Transaction.Nonce < peer.Ledger.get_account(entry.Transaction.From).Nonce {
+			peer.Mempool.remove(transaction_hash)
+		}
+	}
+	if peer.Ledger.Mode == ledger_mode_utxo {
+		peer.Mempool.remove_unspendable(peer.Ledger)
+	}
+}
+
+// Peer's method __create_transaction creates a transaction of a random amount from the peer's account to another
+// known account and signs it. the nonce and balance account for the peer's own transactions that are not in a block yet.
+// returns false if the peer can not afford a transaction or knows no other account
+func (peer *Peer) __create_transaction() (Transaction, bool) {
+	from := peer.__account()
+	receivers := make([]string, 0)
+	for _, address := range peer.Ledger.known_addresses() {
+		if address != from {
+			receivers = append(receivers, address)
+		}
+	}
+	if len(receivers) == 0 {
+		return Transaction{}, false
+	}
+
+	to := receivers[random_int(0, int64(len(receivers)-1))]
+	if peer.Ledger.Mode == ledger_mode_utxo {
+		return peer.__create_utxo_transaction(to)
+	}
+
+	account := peer.Ledger.get_account(from)
+	available, nonce := account.Balance, account.Nonce
+	for _, pending := range peer.Mempool.pending_from(from) {
+		if pending.Nonce >= account.Nonce {
+			available -= min(available, pending.Amount+pending.Fee)
+			nonce = max(nonce, pending.Nonce+1)
+		}
+	}
+	fee := uint64(random_int(1, 3))
+	if available <= fee {
+		return Transaction{}, false
+	}
+	amount := uint64(random_int(1, int64(max(1, (available-fee)/4))))
+	transaction := create_transaction(from, to, amount, fee, nonce, random_string(8))
+	transaction.sign(peer.pc.Private_Key)
+	return transaction, true
+}
+
+// Peer's method __create_utxo_transaction creates a transaction paying a random amount to the given address from the
+// peer's unspent outputs that no pending transaction spends. the remainder is paid back to the peer as change
+func (peer *Peer) __create_utxo_transaction(to string) (Transaction, bool) {
+	from := peer.__account()
+	available_inputs, available := make([]OutPoint, 0), uint64(0)
+	for _, out_point := range peer.Ledger.get_utxos(from) {
+		if !peer.Mempool.spends(out_point) {
+			available_inputs = append(available_inputs, out_point)
+			available += peer.Ledger.Utxos[out_point].Output.Amount
+		}
+	}
+	fee := uint64(random_int(1, 3))
+	if available <= fee {
+		return Transaction{}, false
+	}
+	amount := uint64(random_int(1, int64(max(1, (available-fee)/4))))
+
+	inputs, total_in := make([]OutPoint, 0), uint64(0)
+	for _, out_point := range available_inputs {
+		if total_in >= amount+fee {
+			break
+		}
+		inputs = append(inputs, out_point)
+		total_in += peer.Ledger.Utxos[out_point].Output.Amount
+	}
+	outputs := []TxOutput{{Owner: to, Amount: amount}}
+	if change := total_in - amount - fee; change > 0 {
+		outputs = append(outputs, TxOutput{Owner: from, Amount: change})
+	}
+	transaction := create_utxo_transaction(from, inputs, outputs, fee, random_string(8))
+	transaction.sign(peer.pc.Private_Key)
+	return transaction, true
+}
+
 // Peer's method __do_hello sends a hello to a neighbour if the time since the last hello was sent is >= timeout / 8
 func (peer *Peer) __do_hello(last_hello *map[Address]int64, timeout int64, target Address) {
 	last_hello_time, ok := (*last_hello)[target]
@@ -297,12 +755,13 @@ func (peer *Peer) __do_hello(last_hello *map[Address]int64, timeout int64, targe
 	if time.Now().Unix()-last_hello_time < timeout/8 {
 		return
 	}
-	packet_to_send := NetworkPacket{Req_Type: req_type_hello, Req_From: peer.My_Address}
-	go __send_request(packet_to_send, target)
+	peer.__send(HelloMessage{}, target)
 	(*last_hello)[target] = time.Now().Unix()
 }
 
-// Peer's method __evaluate_block_groups
+// Peer's method __evaluate_block_groups adds the received block groups whose previous block is in the blockchain to
+// it and drops groups that waited too long. for a group that does not follow the blockchain yet, the blocks leading
+// to it are requested at most once a second
 func (peer *Peer) __evaluate_block_groups(last_block_request *int64) {
 
 	// block groups to remove
@@ -338,12 +797,17 @@ func (peer *Peer) __evaluate_block_groups(last_block_request *int64) {
 			// remove the block group that was potentially added to chain
 			to_remove = append(to_remove, prev_hash)
 
-		} else if time.Now().Unix()-*last_block_request > 0 {
+		} else if peer.Sync == nil && time.Now().Unix()-*last_block_request > 0 {
 
-			// request the neighbours for the block that should come before the earliest block in the given block group
-			packet_to_send := NetworkPacket{Req_Type: req_type_need_block, Req_From: peer.My_Address, Block_Hash: prev_hash}
-			for neighbour := range peer.Neighbours {
-				go __send_request(packet_to_send, neighbour)
+			// request the blocks between the peer's chain and the earliest block in the given block group from the
+			// neighbour that sent the group, or from every neighbour if it is gone
+			source, ok := peer.Block_Sources[prev_hash]
+			if _, in_neighbours := peer.Neighbours[source]; ok && in_neighbours {
+				peer.__request_blocks(prev_hash, source)
+			} else {
+				for neighbour := range peer.Neighbours {
+					peer.__request_blocks(prev_hash, neighbour)
+				}
 			}
 			*last_block_request = time.Now().Unix()
 		}
@@ -351,9 +815,30 @@ func (peer *Peer) __evaluate_block_groups(last_block_request *int64) {
 
 	// remove block groups that are required to be removed
 	for _, prev_hash := range to_remove {
-		delete(peer.Block_Groups, prev_hash)
+		peer.__forget_block_group(prev_hash)
 		delete(peer.Blocks, prev_hash)
+		delete(peer.Block_Sources, prev_hash)
+	}
+}
+
+// Peer's method __forget_block_group removes the block group waiting for the given previous block hash and the
+// hashes of its blocks
+func (peer *Peer) __forget_block_group(prev_hash Hash) {
+	for _, block := range peer.Block_Groups[prev_hash] {
+		delete(peer.Grouped_Blocks, block.hashed())
+	}
+	delete(peer.Block_Groups, prev_hash)
+}
+
+// Peer's method __request_blocks asks a neighbour for the blocks from where its chain and the peer's best chain fork
+// up to the block with the given hash. neighbours that do not send blocks for a locator are asked for that block
+// alone, the blocks before it are then requested one by one as they arrive
+func (peer *Peer) __request_blocks(block_hash Hash, neighbour Address) {
+	if !peer.Neighbour_Handshakes[neighbour].has_feature(feature_get_blocks) {
+		peer.__send(NeedBlockMessage{Block_Hash: block_hash}, neighbour)
+		return
 	}
+	peer.__send(GetBlocksMessage{Locator: peer.Blockchain.locator(peer.Blockchain.get_last_hash(), nil), Stop: block_hash}, neighbour)
 }
 
 // Peer's method __try_add_neighbours sends neighbour connection request to random peers in the given list
@@ -371,91 +856,162 @@ func (peer *Peer) __try_add_neighbours(ip_port_list []Address) {
 			continue
 		}
 
-		packet_to_send := NetworkPacket{Req_Type: req_type_new_connection, Req_From: peer.My_Address}
-		go __send_request(packet_to_send, target_peer)
+		peer.__send(NewConnectionMessage{Handshake: peer.__handshake()}, target_peer)
 		need_neighbours--
 	}
 }
 
+// Peer's method __receive_transaction adds a transaction received from the given address to the peer's transactions
+// and propagates it to every neighbour that does not have it yet, unless the peer already has it or can not accept it
+func (peer *Peer) __receive_transaction(transaction Transaction, from Address) {
+	if peer.Mempool.has(transaction.hashed()) || !peer.__is_acceptable_transaction(transaction) {
+		return
+	}
+	if _, ok := peer.Mempool.add(transaction); !ok {
+		return // the mempool is full of transactions paying at least as much
+	}
+	peer.__propagate_transaction(transaction) // the sender is known to have it if it is a neighbour
+
+	// report that a new transaction has been received
+	peer.pc.Up_Channel <- ReportToMain{
+		Source_Address: peer.My_Address,
+		Report_Type:    report_type_received_transaction,
+		Report_Body:    fmt.Sprintf("%v from %v", transaction.to_string(), from.to_string()),
+	}
+}
+
+// Peer's method __receive_block adds a block a neighbour sent to the block groups, from where it is added to the
+// blockchain once the blocks before it are in
+func (peer *Peer) __receive_block(block Block, merkel_tree MerkelTree, from Address) {
+	if peer.pc.Is_Bad_Node || block.Trailing_Zeros < peer.pc.Chain_Params.Min_Trailing_Zeros || !block.is_valid() {
+		return
+	}
+	merkel_tree.build() // trees are built only once their sender is known to be a neighbour
+	if merkel_tree.hashed() != block.Merkel_Root || !merkel_tree.has_valid_signatures() {
+		return
+	}
+	block_hash := block.hashed()
+	prev_data, in_groups := peer.Block_Groups[block_hash]
+	if in_groups {
+		delete(peer.Block_Groups, block_hash)
+		delete(peer.Blocks, block_hash)
+		delete(peer.Block_Sources, block_hash)
+		prev_data = append(prev_data, block)
+	} else {
+		prev_data = []Block{block}
+	}
+	peer.Merkel_Trees[merkel_tree.hashed()] = merkel_tree
+	peer.__forget_block_group(block.Prev_Block)
+	peer.Block_Groups[block.Prev_Block] = prev_data
+	peer.Grouped_Blocks[block_hash] = true
+	peer.Blocks[block.Prev_Block] = time.Now().Unix()
+	peer.Block_Sources[block.Prev_Block] = from
+
+	// a block more than one block ahead of the peer's tip means the peer fell behind, catch up by headers instead
+	// of requesting the missing blocks one by one
+	_, prev_known := peer.Blockchain.Blocks[block.Prev_Block]
+	tip := peer.Blockchain.Blocks[peer.Blockchain.get_last_hash()]
+	if !prev_known && block.Height > tip.Height+1 && peer.Neighbour_Handshakes[from].has_feature(feature_header_sync) {
+		peer.__start_sync(from)
+	}
+
+	// report that a new block has been received
+	peer.pc.Up_Channel <- ReportToMain{
+		Source_Address: peer.My_Address,
+		Report_Type:    report_type_received_block,
+		Report_Body:    fmt.Sprintf("%v from %v", block_hash.to_string(), from),
+	}
+}
+
 // Peer's method __handle_network_packet deals with the given packet as per requirement
 func (peer *Peer) __handle_network_packet(packet *NetworkPacket) {
+	// a packet is only taken for a neighbour's if it came in on the connection to the neighbour, since anyone can claim
+	// the neighbour's address
 	_, in_neighbours := peer.Neighbours[packet.Req_From]
-	switch packet.Req_Type {
-	case req_type_new_connection:
-		if len(peer.Neighbours) < peer.Max_Neighbours {
-			peer.Neighbours[packet.Req_From] = time.Now().Unix()
-			go __send_request(NetworkPacket{Req_Type: req_type_accept_connection, Req_From: peer.My_Address}, packet.Req_From)
+	in_neighbours = in_neighbours && peer.Connections.bind(*packet)
+	switch message := packet.Message.(type) {
+	case NewConnectionMessage:
+		if len(peer.Neighbours) < peer.Max_Neighbours && peer.__complete_handshake(packet, message.Handshake) {
+			peer.__send(AcceptConnectionMessage{Handshake: peer.__handshake()}, packet.Req_From)
 		} else {
-			go __send_request(NetworkPacket{Req_Type: req_type_reject_connection, Req_From: peer.My_Address}, packet.Req_From)
+			peer.Connections.reply(*packet, RejectConnectionMessage{})
 		}
-	case req_type_accept_connection:
-		peer.Neighbours[packet.Req_From] = time.Now().Unix()
-	case req_type_new_transaction:
-		if !in_neighbours {
-			return
+	case AcceptConnectionMessage:
+		peer.__complete_handshake(packet, message.Handshake)
+	case NewTransactionMessage:
+		if in_neighbours {
+			peer.__received_item(message.Transaction.hashed(), packet.Req_From)
+			peer.__receive_transaction(message.Transaction, packet.Req_From)
 		}
-		_, already_exists := peer.Transactions[packet.Transaction.hashed()]
-		if !already_exists {
-			peer.Transactions[packet.Transaction.hashed()] = packet.Transaction // add transaction to list of transactions
-			packet_to_send := NetworkPacket{Req_Type: req_type_new_transaction, Req_From: peer.My_Address, Transaction: packet.Transaction}
-			for neighbour := range peer.Neighbours {
-				if neighbour != packet.Req_From {
-					go __send_request(packet_to_send, neighbour) // propagate transaction to all neighbours except sender
-				}
-			}
-
-			// report that a new transaction has been received
-			peer.pc.Up_Channel <- ReportToMain{
-				Source_Address: peer.My_Address,
-				Report_Type:    report_type_received_transaction,
-				Report_Body:    fmt.Sprintf("%v from %v", packet.Transaction.Value, packet.Req_From),
-			}
-
+	case SubmitTransactionMessage:
+		peer.__receive_transaction(message.Transaction, packet.Req_From) // submitted transactions may come from anyone, e.g. a wallet
+	case GetMempoolMessage:
+		peer.__serve_mempool(*packet, message.Address) // as may mempool queries
+	case NewBlockMessage:
+		if in_neighbours {
+			peer.__received_item(message.Block.hashed(), packet.Req_From)
+			peer.__receive_block(message.Block, message.Merkel_Tree, packet.Req_From)
 		}
-	case req_type_new_block:
-		if !in_neighbours {
-			return
+	case CompactBlockMessage:
+		if in_neighbours {
+			peer.__received_item(message.Block.hashed(), packet.Req_From)
+			peer.__receive_compact_block(message, packet.Req_From)
 		}
-		if peer.pc.Is_Bad_Node || packet.Block.Trailing_Zeros < peer.pc.Trailing_Zeros || !packet.Block.is_valid() || !packet.Merkel_Tree.is_valid() {
-			return
+	case GetBlockTransactionsMessage:
+		if in_neighbours {
+			peer.__serve_block_transactions(message, packet.Req_From)
 		}
-		block_hash := packet.Block.hashed()
-		prev_data, in_groups := peer.Block_Groups[block_hash]
-		if in_groups {
-			delete(peer.Block_Groups, block_hash)
-			delete(peer.Blocks, block_hash)
-			prev_data = append(prev_data, packet.Block)
-		} else {
-			prev_data = []Block{packet.Block}
+	case BlockTransactionsMessage:
+		if in_neighbours {
+			peer.__receive_block_transactions(message, packet.Req_From)
 		}
-		peer.Merkel_Trees[packet.Merkel_Tree.hashed()] = packet.Merkel_Tree
-		peer.Block_Groups[packet.Block.Prev_Block] = prev_data
-		peer.Blocks[packet.Block.Prev_Block] = time.Now().Unix()
-
-		// report that a new block has been received
-		peer.pc.Up_Channel <- ReportToMain{
-			Source_Address: peer.My_Address,
-			Report_Type:    report_type_received_block,
-			Report_Body:    fmt.Sprintf("%v from %v", packet.Block.hashed().to_string(), packet.Req_From),
+	case InvMessage:
+		if in_neighbours {
+			peer.__receive_inventory(message.Items, packet.Req_From)
 		}
-	case req_type_need_block:
-		block, exists := peer.Blockchain.Blocks[packet.Block_Hash]
+	case GetDataMessage:
+		if in_neighbours {
+			peer.__serve_data(message.Items, packet.Req_From)
+		}
+	case GetBlocksMessage:
+		if in_neighbours {
+			for _, block := range peer.Blockchain.blocks_from_locator(message.Locator, message.Stop, max_get_blocks_count) {
+				peer.__send(NewBlockMessage{Block: block, Merkel_Tree: peer.Blockchain.Merkel_Trees[block.Merkel_Root]}, packet.Req_From)
+			}
+		}
+	case NeedBlockMessage:
+		block, exists := peer.Blockchain.Blocks[message.Block_Hash]
 		if exists {
-			packet_to_send := NetworkPacket{Req_Type: req_type_new_block, Req_From: peer.My_Address, Block: block, Merkel_Tree: peer.Merkel_Trees[block.Merkel_Root]}
-			go __send_request(packet_to_send, packet.Req_From)
+			peer.Connections.reply(*packet, NewBlockMessage{Block: block, Merkel_Tree: peer.Blockchain.Merkel_Trees[block.Merkel_Root]})
+		}
+	case GetHeadersMessage:
+		if in_neighbours {
+			peer.__send(HeadersMessage{Headers: peer.Blockchain.headers_after(message.Locator, message.Stop, max_headers_count)}, packet.Req_From)
+		}
+	case HeadersMessage:
+		if in_neighbours {
+			peer.__receive_headers(message.Headers, packet.Req_From)
+		}
+	case GetBlockBodiesMessage:
+		if in_neighbours {
+			peer.__serve_bodies(message.Block_Hashes, packet.Req_From)
+		}
+	case BlockBodiesMessage:
+		if in_neighbours {
+			peer.__receive_bodies(message.Merkel_Trees, packet.Req_From)
 		}
-	case req_type_need_ip_port_list:
+	case NeedIpPortListMessage:
 		if peer.Is_Bootstrap {
 			network_members := get_map_keys(peer.Network_Members)
-			new_packet := NetworkPacket{Req_Type: req_type_ip_port_list, Req_From: peer.My_Address, Ip_Port_List: network_members}
+			network_members = network_members[:min(len(network_members), max_ip_port_list_size)] // random members, maps are not ordered
 			peer.Network_Members[packet.Req_From] = time.Now().Unix()
-			go __send_request(new_packet, packet.Req_From)
+			peer.Connections.reply(*packet, IpPortListMessage{Ip_Port_List: network_members})
 		}
-	case req_type_ip_port_list:
+	case IpPortListMessage:
 		if packet.Req_From == peer.Bootstrap_Address {
-			peer.__try_add_neighbours(packet.Ip_Port_List)
+			peer.__try_add_neighbours(message.Ip_Port_List)
 		}
-	case req_type_hello:
+	case HelloMessage:
 		if in_neighbours || packet.Req_From == peer.Bootstrap_Address || peer.Is_Bootstrap {
 			if in_neighbours {
 				peer.Neighbours[packet.Req_From] = time.Now().Unix()
@@ -463,9 +1019,9 @@ func (peer *Peer) __handle_network_packet(packet *NetworkPacket) {
 			if peer.Is_Bootstrap {
 				peer.Network_Members[packet.Req_From] = time.Now().Unix()
 			}
-			go __send_request(NetworkPacket{Req_Type: req_type_hi, Req_From: peer.My_Address}, packet.Req_From)
+			peer.Connections.reply(*packet, HiMessage{})
 		}
-	case req_type_hi:
+	case HiMessage:
 		if in_neighbours || packet.Req_From == peer.Bootstrap_Address || peer.Is_Bootstrap {
 			if in_neighbours {
 				peer.Neighbours[packet.Req_From] = time.Now().Unix()
@@ -477,29 +1033,28 @@ func (peer *Peer) __handle_network_packet(packet *NetworkPacket) {
 	}
 }
 
-// function __transaction_creator runs infinitely and creates a random transaction after a random interval and
-// sends it to the channel that was passed to this function as a input
-func __transaction_creator(up_channel chan<- Transaction) {
+// function __transaction_creator runs infinitely and signals the channel that was passed to this function as a input
+// after a random interval, asking the peer to create a random transaction
+func __transaction_creator(up_channel chan<- struct{}) {
 	var second int64 = 1000000000
 	for {
 		time.Sleep(time.Duration(random_int(2*second, 8*second)))
-		transaction := Transaction{Value: random_string(15), Not_Null: true}
-		up_channel <- transaction
+		up_channel <- struct{}{}
 	}
 }
 
-// function __mine_new_block uses the given transactions, prev_hash value, and trailing_zeros count to create a new block
+// function __mine_new_block uses the given transactions, prev_hash value, height, timestamp and trailing_zeros count to create a new block
 // and mine a valid nonce value. once complete, the block is written to the channel that was passed to this function as input
 func __mine_new_block(up_channel chan<- struct {
 	Block
 	MerkelTree
-}, transactions []Transaction, prev_hash Hash, trailing_zeros int) {
+}, transactions []Transaction, prev_hash Hash, height uint64, timestamp int64, trailing_zeros int) {
 	merkel_tree := create_merkel_tree()
 	for _, transaction := range transactions {
 		merkel_tree.add_transaction(transaction)
 	}
 	merkel_tree.build()
-	block := create_block(merkel_tree.hashed(), prev_hash, trailing_zeros)
+	block := create_block(merkel_tree.hashed(), prev_hash, height, timestamp, trailing_zeros)
 	block.mine()
 	up_channel <- struct {
 		Block
@@ -507,40 +1062,15 @@ func __mine_new_block(up_channel chan<- struct {
 	}{block, merkel_tree}
 }
 
-// function __listen listens a given address and writes any packet it recieves to the channel that was passed to it as input
-func __listen(up_channel chan<- NetworkPacket, address Address) {
-	ln, err := net.Listen("tcp", address.to_string())
+// function send request sends the given network packet to the given target address on a connection of its own that
+// is closed right after. used by clients that send a single packet, peers keep their connections in a ConnectionPool
+func __send_request(network_packet NetworkPacket, target Address) error {
+	conn, err := net.DialTimeout("tcp", target.to_string(), connection_io_timeout)
 	if err != nil {
-		fmt.Println("Error starting listening", err)
+		fmt.Printf("Network Dial to %d failed: %v\n", target.Port, err)
+		return err
 	}
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Printf("Network Listen at %d failed\n", address.Port)
-			continue
-		}
-		go __receive_request(up_channel, conn)
-	}
-}
-
-// function send request sends the given network packet to the given target address from a random port
-func __send_request(network_packet NetworkPacket, target Address) {
-	conn, err := net.Dial("tcp", target.to_string())
-	if err != nil {
-		fmt.Printf("Network Dial from %d to %d failed: %v\n", network_packet.Req_From.Port, target.Port, err)
-		return
-	}
-	encoder := gob.NewEncoder(conn)
-	encoder.Encode(&network_packet)
-	conn.Close()
-}
-
-// function receive request uses a connection and receives the network packet sent on it. this is then written to
-// channel that is passed to it as input
-func __receive_request(up_channel chan<- NetworkPacket, conn net.Conn) {
-	dec := gob.NewDecoder(conn)
-	network_packet := &NetworkPacket{}
-	dec.Decode(&network_packet)
-	up_channel <- *network_packet
-	conn.Close()
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(connection_io_timeout))
+	return write_frame(conn, network_packet)
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"time"
@@ -74,6 +77,55 @@ func handle_reports(report <-chan ReportToMain, to_print []int) {
 				report.Source_Address.to_string())
 		}
 
+		if report.Report_Type == report_type_reorg && bit_is_set(set, report_type_reorg) {
+			fmt.Printf(
+				"%v - Reorganized its blockchain: %v\n",
+				report.Source_Address.to_string(),
+				report.Report_Body)
+		}
+
+		if report.Report_Type == report_type_rejected_reorg && bit_is_set(set, report_type_rejected_reorg) {
+			fmt.Printf(
+				"%v - Refused a reorganization: %v\n",
+				report.Source_Address.to_string(),
+				report.Report_Body)
+		}
+
+		if report.Report_Type == report_type_dropped_packets && bit_is_set(set, report_type_dropped_packets) {
+			fmt.Printf(
+				"%v - Dropped packets of other networks or malformed packets: %v\n",
+				report.Source_Address.to_string(),
+				report.Report_Body)
+		}
+
+		if report.Report_Type == report_type_handshake && bit_is_set(set, report_type_handshake) {
+			fmt.Printf(
+				"%v - Handshake: %v\n",
+				report.Source_Address.to_string(),
+				report.Report_Body)
+		}
+
+		if report.Report_Type == report_type_sync && bit_is_set(set, report_type_sync) {
+			fmt.Printf(
+				"%v - Synchronizing its blockchain: %v\n",
+				report.Source_Address.to_string(),
+				report.Report_Body)
+		}
+
+		if report.Report_Type == report_type_compact_blocks && bit_is_set(set, report_type_compact_blocks) {
+			fmt.Printf(
+				"%v - Compact blocks: %v\n",
+				report.Source_Address.to_string(),
+				report.Report_Body)
+		}
+
+		if report.Report_Type == report_type_mempool && bit_is_set(set, report_type_mempool) {
+			fmt.Printf(
+				"%v - Mempool: %v\n",
+				report.Source_Address.to_string(),
+				report.Report_Body)
+		}
+
 		if report.Report_Type == report_type_entire_blockchain && bit_is_set(set, report_type_entire_blockchain) {
 			filename := fmt.Sprintf("Blockchain_%d.txt", report.Source_Address.Port)
 			write_to_file(filename, report.Report_Body)
@@ -82,19 +134,72 @@ func handle_reports(report <-chan ReportToMain, to_print []int) {
 	}
 }
 
+// function log_reports writes every report in the channel whose type is in to_print as a line to out.
+// it returns once the channel is closed and is used when a single peer runs as its own process
+func log_reports(report <-chan ReportToMain, to_print []int, out io.Writer) {
+	set := uint64(0)
+	for _, value := range to_print {
+		set |= (1 << value)
+	}
+
+	names := make(map[int]string)
+	for name, report_type := range report_type_names {
+		names[report_type] = name
+	}
+
+	for report := range report {
+		if !bit_is_set(set, report.Report_Type) {
+			continue
+		}
+		fmt.Fprintf(out, "%s %v %s: %s\n",
+			time.Now().Format(time.RFC3339),
+			report.Source_Address.to_string(),
+			names[report.Report_Type],
+			report.Report_Body)
+	}
+}
+
+// function scenario_key returns the private key of the peer listening on the given port in a scenario. the keys are
+// derived from the port so that the initial balances can be given to the peers' accounts in advance
+func scenario_key(port int) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte(fmt.Sprintf("scenario peer %d", port)))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// function scenario_chain_params returns the chain parameters shared by every peer of a scenario. the account of each
+// port used by the scenarios starts with some balance so that the transaction makers can pay each other
+func scenario_chain_params() ChainParams {
+	initial_balances := make(map[string]uint64)
+	for port := 8080; port <= 8089; port++ {
+		initial_balances[address_from_key(scenario_key(port))] = 1000
+	}
+	return ChainParams{
+		Network_Id:             "scenario",
+		Genesis_Timestamp:      default_genesis_timestamp,
+		Initial_Balances:       initial_balances,
+		Block_Reward:           50,
+		Coinbase_Maturity:      3,
+		Initial_Trailing_Zeros: 20,
+		Min_Trailing_Zeros:     8,
+		Target_Block_Time:      10,
+		Retarget_Interval:      10,
+		Max_Retarget_Step:      2,
+	}
+}
+
 // function scenario_connection_control shows a scenario where the changes in connections for each peer as
 // new peers change or existing peers leave
 func scenario_connection_control() {
 
 	reports := make(chan ReportToMain, 100)
-	go handle_reports(reports, []int{report_type_connections})
+	go handle_reports(reports, []int{report_type_connections, report_type_handshake})
 
 	max_neighbours := 3
 	bootstrap_address := Address{Port: 8080}
 
 	peer_config := PeerConfig{
 		Self_Address:          Address{Port: 8080},
-		Trailing_Zeros:        20,
+		Private_Key:           scenario_key(8080),
 		Is_Bootstrap:          true,
 		Is_Miner:              false,
 		Is_Transaction_Maker:  false,
@@ -103,6 +208,9 @@ func scenario_connection_control() {
 		Max_Neighbours:        max_neighbours,
 		Die_After:             int64(-1),
 		Up_Channel:            reports,
+		Chain_Params:          scenario_chain_params(),
+		Side_Branch_Depth:     20,
+		Mempool_Limits:        default_mempool_limits(),
 	}
 
 	go peer_main(peer_config)
@@ -117,6 +225,7 @@ func scenario_connection_control() {
 		}
 
 		peer_config.Self_Address = Address{Port: uint16(i)}
+		peer_config.Private_Key = scenario_key(i)
 		go peer_main(peer_config)
 
 		if i == 8081 {
@@ -128,6 +237,7 @@ func scenario_connection_control() {
 	time.Sleep(30 * time.Second)
 
 	peer_config.Self_Address = Address{Port: 8089}
+	peer_config.Private_Key = scenario_key(8089)
 	go peer_main(peer_config)
 	fmt.Printf("Port %d joined the network!\n", 8089)
 
@@ -145,6 +255,8 @@ func scenario_blockchain_observation() {
 		report_type_block_mined,
 		report_type_received_block,
 		report_type_blockchain_updated,
+		report_type_reorg,
+		report_type_rejected_reorg,
 		report_type_entire_blockchain,
 		report_type_connections})
 
@@ -153,7 +265,7 @@ func scenario_blockchain_observation() {
 
 	peer_config := PeerConfig{
 		Self_Address:          Address{Port: 8080},
-		Trailing_Zeros:        20,
+		Private_Key:           scenario_key(8080),
 		Is_Bootstrap:          true,
 		Is_Miner:              false,
 		Is_Transaction_Maker:  false,
@@ -162,6 +274,9 @@ func scenario_blockchain_observation() {
 		Max_Neighbours:        max_neighbours,
 		Die_After:             int64(-1),
 		Up_Channel:            reports,
+		Chain_Params:          scenario_chain_params(),
+		Side_Branch_Depth:     20,
+		Mempool_Limits:        default_mempool_limits(),
 	}
 
 	go peer_main(peer_config)
@@ -173,6 +288,7 @@ func scenario_blockchain_observation() {
 		peer_config.Is_Miner = i%2 == 1
 		peer_config.Is_Transaction_Maker = i%2 == 0
 		peer_config.Self_Address = Address{Port: uint16(i)}
+		peer_config.Private_Key = scenario_key(i)
 
 		go peer_main(peer_config)
 	}
@@ -182,6 +298,7 @@ func scenario_blockchain_observation() {
 	peer_config.Is_Miner = true
 	peer_config.Is_Transaction_Maker = true
 	peer_config.Self_Address = Address{Port: 8089}
+	peer_config.Private_Key = scenario_key(8089)
 	go peer_main(peer_config)
 	fmt.Printf("Port %d joined the network!\n", 8089)
 
@@ -199,6 +316,8 @@ func scenario_blockchain_bad_node() {
 		report_type_block_mined,
 		report_type_received_block,
 		report_type_blockchain_updated,
+		report_type_reorg,
+		report_type_rejected_reorg,
 		report_type_entire_blockchain,
 		report_type_connections})
 
@@ -207,7 +326,7 @@ func scenario_blockchain_bad_node() {
 
 	peer_config := PeerConfig{
 		Self_Address:          Address{Port: 8080},
-		Trailing_Zeros:        20,
+		Private_Key:           scenario_key(8080),
 		Is_Bootstrap:          true,
 		Is_Miner:              false,
 		Is_Transaction_Maker:  false,
@@ -216,6 +335,9 @@ func scenario_blockchain_bad_node() {
 		Max_Neighbours:        max_neighbours,
 		Die_After:             int64(-1),
 		Up_Channel:            reports,
+		Chain_Params:          scenario_chain_params(),
+		Side_Branch_Depth:     20,
+		Mempool_Limits:        default_mempool_limits(),
 	}
 
 	go peer_main(peer_config)
@@ -227,6 +349,7 @@ func scenario_blockchain_bad_node() {
 		peer_config.Is_Miner = i%2 == 1
 		peer_config.Is_Transaction_Maker = i%2 == 0
 		peer_config.Self_Address = Address{Port: uint16(i)}
+		peer_config.Private_Key = scenario_key(i)
 
 		go peer_main(peer_config)
 	}
@@ -234,6 +357,7 @@ func scenario_blockchain_bad_node() {
 	// bad node
 	peer_config.Is_Miner = true
 	peer_config.Self_Address = Address{Port: 8087}
+	peer_config.Private_Key = scenario_key(8087)
 	peer_config.Is_Bad_Node = true
 	go peer_main(peer_config)
 
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// names of the files a BlockStore keeps in its directory
+const (
+	block_store_data_file  = "blocks.dat"
+	block_store_index_file = "blocks.idx"
+)
+
+// size of a single index record: a block hash followed by the offset of the block in the data file
+const block_store_index_record_size = 32 + 8
+
+// Type StoredBlock is a single record of the data file of a BlockStore
+type StoredBlock struct {
+	Block       Block
+	Merkel_Tree MerkelTree
+}
+
+// Type BlockStore keeps blocks along with their merkel trees on disk. blocks are appended to a data file as
+// length prefixed gob records and an index file maps each block hash to the offset of its record
+type BlockStore struct {
+	Dir        string
+	Read_Only  bool
+	data_file  *os.File
+	index_file *os.File
+	data_size  int64
+	Index      map[Hash]int64 // {block hash: offset in the data file}
+	Order      []Hash         // block hashes in the order they were stored
+}
+
+// function open_block_store opens the block store in the given directory, creating it unless read_only is set.
+// blocks that made it to the data file but not the index (e.g. the peer was killed in between) are indexed again
+// and a partially written record at the end of the data file is dropped
+func open_block_store(dir string, read_only bool) (*BlockStore, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if read_only {
+		flags = os.O_RDONLY
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	data_file, err := os.OpenFile(filepath.Join(dir, block_store_data_file), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index_file, err := os.OpenFile(filepath.Join(dir, block_store_index_file), flags, 0644)
+	if err != nil {
+		data_file.Close()
+		return nil, err
+	}
+	store := &BlockStore{Dir: dir, Read_Only: read_only, data_file: data_file, index_file: index_file, Index: make(map[Hash]int64)}
+	if err := store.__recover(); err != nil {
+		store.close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// BlockStore's method __recover reads the index file and then scans the data file past the last indexed record
+func (store *BlockStore) __recover() error {
+	info, err := store.data_file.Stat()
+	if err != nil {
+		return err
+	}
+	store.data_size = info.Size()
+
+	raw_index, err := io.ReadAll(store.index_file)
+	if err != nil {
+		return err
+	}
+	scan_from := int64(0)
+	for i := 0; i+block_store_index_record_size <= len(raw_index); i += block_store_index_record_size {
+		block_hash := Hash{}
+		copy(block_hash.Value[:], raw_index[i:i+32])
+		offset := int64(binary.BigEndian.Uint64(raw_index[i+32 : i+40]))
+		_, length, err := store.__read_record(offset)
+		if err != nil {
+			break // the index points past the end of the data, rely on the scan below
+		}
+		store.__add_to_index(block_hash, offset)
+		scan_from = max(scan_from, offset+4+length)
+	}
+	if !store.Read_Only {
+		// drop a partially written index record and anything the data file does not back
+		if err := store.index_file.Truncate(int64(len(store.Order) * block_store_index_record_size)); err != nil {
+			return err
+		}
+		if _, err := store.index_file.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	for scan_from < store.data_size {
+		record, length, err := store.__read_record(scan_from)
+		if err != nil {
+			break
+		}
+		block_hash := record.Block.hashed()
+		if !store.Read_Only {
+			if err := store.__write_index(block_hash, scan_from); err != nil {
+				return err
+			}
+		}
+		store.__add_to_index(block_hash, scan_from)
+		scan_from += 4 + length
+	}
+	if scan_from < store.data_size && !store.Read_Only {
+		if err := store.data_file.Truncate(scan_from); err != nil {
+			return err
+		}
+		store.data_size = scan_from
+	}
+	return nil
+}
+
+func (store *BlockStore) __add_to_index(block_hash Hash, offset int64) {
+	if _, ok := store.Index[block_hash]; !ok {
+		store.Order = append(store.Order, block_hash)
+	}
+	store.Index[block_hash] = offset
+}
+
+func (store *BlockStore) __write_index(block_hash Hash, offset int64) error {
+	record := append(append([]byte{}, block_hash.Value[:]...), binary.BigEndian.AppendUint64(nil, uint64(offset))...)
+	_, err := store.index_file.Write(record)
+	return err
+}
+
+// BlockStore's method __read_record reads the record at the given offset of the data file and returns it along with
+// the length of its body
+func (store *BlockStore) __read_record(offset int64) (StoredBlock, int64, error) {
+	record := StoredBlock{}
+	if offset < 0 || offset+4 > store.data_size {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, 4)
+	if _, err := store.data_file.ReadAt(header, offset); err != nil {
+		return record, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header))
+	if offset+4+length > store.data_size {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, length)
+	if _, err := store.data_file.ReadAt(body, offset+4); err != nil {
+		return record, 0, err
+	}
+	err := gob.NewDecoder(bytes.NewReader(body)).Decode(&record)
+	return record, length, err
+}
+
+// BlockStore's method has_block returns true if the block with the given hash is stored
+func (store *BlockStore) has_block(block_hash Hash) bool {
+	_, ok := store.Index[block_hash]
+	return ok
+}
+
+// BlockStore's method put_block appends a block and its merkel tree to the store. has no effect if the block is
+// already stored
+func (store *BlockStore) put_block(block Block, merkel_tree MerkelTree) error {
+	if store.Read_Only {
+		return errors.New("block store is read only")
+	}
+	block_hash := block.hashed()
+	if store.has_block(block_hash) {
+		return nil
+	}
+	body := bytes.Buffer{}
+	if err := gob.NewEncoder(&body).Encode(StoredBlock{Block: block, Merkel_Tree: merkel_tree}); err != nil {
+		return err
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(body.Len()))
+	record = append(record, body.Bytes()...)
+	if _, err := store.data_file.WriteAt(record, store.data_size); err != nil {
+		return err
+	}
+	if err := store.data_file.Sync(); err != nil {
+		return err
+	}
+	offset := store.data_size
+	store.data_size += int64(len(record))
+	if err := store.__write_index(block_hash, offset); err != nil {
+		return err
+	}
+	store.__add_to_index(block_hash, offset)
+	return nil
+}
+
+// BlockStore's method get_block reads the block with the given hash along with its merkel tree
+func (store *BlockStore) get_block(block_hash Hash) (Block, MerkelTree, error) {
+	offset, ok := store.Index[block_hash]
+	if !ok {
+		return Block{}, MerkelTree{}, fmt.Errorf("block %s is not stored", block_hash.to_string())
+	}
+	record, _, err := store.__read_record(offset)
+	return record.Block, record.Merkel_Tree, err
+}
+
+// BlockStore's method all_blocks reads every stored block in the order they were stored, so that a block's
+// previous block always comes before it
+func (store *BlockStore) all_blocks() ([]StoredBlock, error) {
+	records := make([]StoredBlock, 0, len(store.Order))
+	for _, block_hash := range store.Order {
+		block, merkel_tree, err := store.get_block(block_hash)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, StoredBlock{Block: block, Merkel_Tree: merkel_tree})
+	}
+	return records, nil
+}
+
+func (store *BlockStore) close() {
+	store.data_file.Close()
+	store.index_file.Close()
+}
+
+// BlockStore's method load_blockchain returns the block tree made up of the stored blocks, side branches included,
+// along with the number of stored blocks that were left out for being invalid under the given chain parameters (or
+// for building on such a block)
+func (store *BlockStore) load_blockchain(params ChainParams) (Blockchain, int, error) {
+	blockchain := create_blockchain(params)
+	records, err := store.all_blocks()
+	if err != nil {
+		return blockchain, 0, err
+	}
+	rejected := 0
+	for _, record := range records {
+		if record.Block.Merkel_Root != record.Merkel_Tree.hashed() || !record.Block.is_valid() || !record.Merkel_Tree.is_valid() || !record.Merkel_Tree.has_valid_signatures() || blockchain.check_block_context(record.Block) != nil || blockchain.check_finality(record.Block) != nil {
+			rejected++
+			continue
+		}
+		blockchain.add_block(record.Block)
+		blockchain.add_merkel_tree(record.Merkel_Tree)
+	}
+	return blockchain, rejected, nil
+}
+
+// function load_blockchain reads the best chain stored in the given directory without changing it
+func load_blockchain(dir string, params ChainParams) (Blockchain, int, error) {
+	store, err := open_block_store(dir, true)
+	if err != nil {
+		return create_blockchain(params), 0, err
+	}
+	defer store.close()
+	blockchain, rejected, err := store.load_blockchain(params)
+	blockchain.remove_short_chains()
+	return blockchain, rejected, err
+}
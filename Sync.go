@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// seconds a neighbour has to answer a request for headers or block bodies before it is asked of another neighbour
+const sync_request_timeout = 10
+
+// block bodies asked of a neighbour in a single request, a neighbour has at most sync_requests_per_neighbour such
+// requests unanswered at any time
+const (
+	sync_bodies_per_request     = 16
+	sync_requests_per_neighbour = 4
+)
+
+// number of headers after the last connected block whose bodies are downloaded, bodies further ahead are requested
+// once the blocks before them are connected
+const sync_download_window = 1024
+
+// Type BodyRequest holds a request for the body of a block that was not answered yet
+type BodyRequest struct {
+	Neighbour Address
+	Sent_At   int64
+}
+
+// Type HeaderSync holds the state of a headers-first synchronization. the headers of the best chain of a neighbour
+// are downloaded first and checked on their own, then the bodies of the blocks are downloaded from every neighbour
+// that serves them in parallel and the blocks are connected in order as their bodies arrive
+type HeaderSync struct {
+	Header_Peer    Address              // neighbour the headers are requested from
+	Header_Request int64                // time headers were last requested, 0 once the neighbour has sent all of them
+	Headers        map[Hash]Block       // {block hash: header} of the headers that are not connected yet
+	Header_Chain   []Hash               // hashes of Headers in order, the first block follows a block of the blockchain
+	Requests       map[Hash]BodyRequest // {block hash: request of its body}
+	Bodies         map[Hash]MerkelTree  // {block hash: body} of the blocks waiting for the blocks before them
+	Started        int64                // time the synchronization started
+	Last_Report    int64                // time progress was last reported
+	Connected      int                  // blocks connected since the synchronization started
+}
+
+// Peer's method __start_sync starts a headers-first synchronization with the given neighbour unless one is running
+func (peer *Peer) __start_sync(neighbour Address) {
+	if peer.Sync != nil {
+		return
+	}
+	peer.Sync = &HeaderSync{
+		Header_Peer:  neighbour,
+		Headers:      make(map[Hash]Block),
+		Header_Chain: make([]Hash, 0),
+		Requests:     make(map[Hash]BodyRequest),
+		Bodies:       make(map[Hash]MerkelTree),
+		Started:      time.Now().Unix(),
+	}
+	peer.__report_sync(fmt.Sprintf("started with %v", neighbour.to_string()))
+	peer.__request_headers()
+}
+
+// Peer's method __stop_sync ends the running synchronization and reports why
+func (peer *Peer) __stop_sync(reason string) {
+	peer.__report_sync(reason)
+	peer.Sync = nil
+}
+
+// Peer's method __report_sync sends a sync report holding the given text and the progress of the synchronization
+func (peer *Peer) __report_sync(text string) {
+	sync := peer.Sync
+	sync.Last_Report = time.Now().Unix()
+	tip := peer.Blockchain.Blocks[peer.Blockchain.get_last_hash()]
+	header_height := tip.Height
+	if len(sync.Header_Chain) > 0 {
+		header_height = sync.Headers[sync.Header_Chain[len(sync.Header_Chain)-1]].Height
+	}
+	peer.pc.Up_Channel <- ReportToMain{
+		Source_Address: peer.My_Address,
+		Report_Type:    report_type_sync,
+		Report_Body: fmt.Sprintf("%s: height %d of %d, %d blocks connected, %d bodies downloading, %ds",
+			text, tip.Height, header_height, sync.Connected, len(sync.Requests), time.Now().Unix()-sync.Started),
+	}
+}
+
+// Peer's method __sync_neighbours returns the neighbours that serve headers and block bodies in a fixed order
+func (peer *Peer) __sync_neighbours() []Address {
+	neighbours := make([]Address, 0, len(peer.Neighbours))
+	for neighbour := range peer.Neighbours {
+		if peer.Neighbour_Handshakes[neighbour].has_feature(feature_header_sync) {
+			neighbours = append(neighbours, neighbour)
+		}
+	}
+	sort.Slice(neighbours, func(i, j int) bool {
+		return neighbours[i].Ip < neighbours[j].Ip || (neighbours[i].Ip == neighbours[j].Ip && neighbours[i].Port < neighbours[j].Port)
+	})
+	return neighbours
+}
+
+// Peer's method __request_headers asks the header peer for the headers that follow the last header downloaded, or
+// the peer's tip if none was downloaded yet
+func (peer *Peer) __request_headers() {
+	sync := peer.Sync
+	from := peer.Blockchain.get_last_hash()
+	if len(sync.Header_Chain) > 0 {
+		from = sync.Header_Chain[len(sync.Header_Chain)-1]
+	}
+	peer.__send(GetHeadersMessage{Locator: peer.Blockchain.locator(from, sync.Headers)}, sync.Header_Peer)
+	sync.Header_Request = time.Now().Unix()
+}
+
+// Peer's method __receive_headers adds the headers sent by the header peer to the header chain. every header has to
+// follow the one before it and carry enough proof of work, the rules that depend on the chain before a block are
+// checked once its body is connected. the synchronization stops if a header is invalid or once all headers are in
+// and they do not lead to a chain with more work than the peer's best chain
+func (peer *Peer) __receive_headers(headers []Block, from Address) {
+	sync := peer.Sync
+	if sync == nil || from != sync.Header_Peer || sync.Header_Request == 0 {
+		return
+	}
+	for _, header := range headers {
+		header_hash := header.hashed()
+		if _, known := peer.Blockchain.Blocks[header_hash]; known && len(sync.Header_Chain) == 0 {
+			continue // connected while the headers were on their way
+		}
+		prev, ok := peer.Blockchain.Blocks[header.Prev_Block]
+		if len(sync.Header_Chain) > 0 {
+			last := sync.Header_Chain[len(sync.Header_Chain)-1]
+			prev, ok = sync.Headers[last], header.Prev_Block == last
+		}
+		if !ok || header.Height != prev.Height+1 || header.Trailing_Zeros < peer.pc.Chain_Params.Min_Trailing_Zeros || !header.is_valid() {
+			peer.__stop_sync(fmt.Sprintf("%v sent an invalid header %s", from.to_string(), header_hash.to_string()))
+			return
+		}
+		sync.Headers[header_hash] = header
+		sync.Header_Chain = append(sync.Header_Chain, header_hash)
+	}
+
+	if len(headers) >= max_headers_count {
+		peer.__report_sync("downloading headers")
+		peer.__request_headers()
+		return
+	}
+	sync.Header_Request = 0
+	if len(sync.Header_Chain) == 0 || peer.__header_chain_work(len(sync.Header_Chain)).Cmp(peer.Blockchain.chain_work(peer.Blockchain.get_last_hash())) <= 0 {
+		peer.__stop_sync(fmt.Sprintf("%v has no chain with more work", from.to_string()))
+		return
+	}
+	peer.__report_sync("downloaded headers")
+}
+
+// Peer's method __header_chain_work returns the total work of the chain ending at the given number of headers from
+// the start of the header chain
+func (peer *Peer) __header_chain_work(count int) *big.Int {
+	sync := peer.Sync
+	work := peer.Blockchain.chain_work(sync.Headers[sync.Header_Chain[0]].Prev_Block)
+	for _, header_hash := range sync.Header_Chain[:count] {
+		work.Add(work, sync.Headers[header_hash].work())
+	}
+	return work
+}
+
+// Peer's method __receive_bodies keeps the bodies a neighbour sent for the blocks it was asked for and connects the
+// blocks whose bodies are in. bodies the neighbour left out are asked of another neighbour once their request times
+// out
+func (peer *Peer) __receive_bodies(merkel_trees []MerkelTree, from Address) {
+	sync := peer.Sync
+	if sync == nil {
+		return
+	}
+	requested := make(map[Hash][]Hash) // {merkel root: hashes of the blocks whose body was asked of the neighbour}
+	for block_hash, request := range sync.Requests {
+		if request.Neighbour == from {
+			merkel_root := sync.Headers[block_hash].Merkel_Root
+			requested[merkel_root] = append(requested[merkel_root], block_hash)
+		}
+	}
+	for _, merkel_tree := range merkel_trees {
+		merkel_tree.build()
+		for _, block_hash := range requested[merkel_tree.hashed()] {
+			sync.Bodies[block_hash] = merkel_tree
+			delete(sync.Requests, block_hash)
+		}
+	}
+	peer.__connect_synced_blocks()
+}
+
+// Peer's method __connect_synced_blocks adds the blocks at the start of the header chain whose bodies are in to the
+// blockchain, after dropping the headers of blocks that reached the blockchain as relayed blocks. a run of blocks that
+// forks off the best chain is only added once it has more work than the best chain or every body is in, so that it is
+// not pruned as a short side branch before the rest of it arrives. the synchronization stops when a block can not be
+// added or once every header is connected
+func (peer *Peer) __connect_synced_blocks() {
+	sync := peer.Sync
+	for len(sync.Header_Chain) > 0 {
+		if _, known := peer.Blockchain.Blocks[sync.Header_Chain[0]]; !known {
+			break
+		}
+		delete(sync.Headers, sync.Header_Chain[0])
+		delete(sync.Bodies, sync.Header_Chain[0])
+		delete(sync.Requests, sync.Header_Chain[0])
+		sync.Header_Chain = sync.Header_Chain[1:]
+	}
+
+	count := 0
+	for count < len(sync.Header_Chain) {
+		if _, ok := sync.Bodies[sync.Header_Chain[count]]; !ok {
+			break
+		}
+		count++
+	}
+	tip := peer.Blockchain.get_last_hash()
+	is_complete := count == len(sync.Header_Chain) && sync.Header_Request == 0
+	if count > 0 && (sync.Headers[sync.Header_Chain[0]].Prev_Block == tip || is_complete || peer.__header_chain_work(count).Cmp(peer.Blockchain.chain_work(tip)) > 0) {
+		blocks, merkel_trees := make([]Block, 0, count), make([]MerkelTree, 0, count)
+		for _, block_hash := range sync.Header_Chain[:count] {
+			blocks = append(blocks, sync.Headers[block_hash])
+			merkel_trees = append(merkel_trees, sync.Bodies[block_hash])
+		}
+		last_hash := sync.Header_Chain[count-1]
+		if peer.__extend_blockchain(blocks, merkel_trees) {
+			peer.__propagate_block(blocks[len(blocks)-1], merkel_trees[len(merkel_trees)-1])
+		}
+		if _, added := peer.Blockchain.Blocks[last_hash]; !added {
+			peer.__stop_sync(fmt.Sprintf("blocks up to %s could not be added", last_hash.to_string()))
+			return
+		}
+		for _, block_hash := range sync.Header_Chain[:count] {
+			delete(sync.Headers, block_hash)
+			delete(sync.Bodies, block_hash)
+		}
+		sync.Header_Chain = sync.Header_Chain[count:]
+		sync.Connected += count
+	}
+
+	if len(sync.Header_Chain) == 0 && sync.Header_Request == 0 {
+		peer.__stop_sync("finished")
+	}
+}
+
+// Peer's method __evaluate_sync moves the running synchronization on: headers are asked of another neighbour if the
+// header peer left or does not answer, unanswered body requests are given up and the bodies of the headers in the
+// download window that are not requested yet are asked of the neighbours that have them in turns
+func (peer *Peer) __evaluate_sync() {
+	sync := peer.Sync
+	if sync == nil {
+		return
+	}
+	now := time.Now().Unix()
+	neighbours := peer.__sync_neighbours()
+	if len(neighbours) == 0 {
+		peer.__stop_sync("no neighbour serves headers")
+		return
+	}
+
+	if _, ok := peer.Neighbours[sync.Header_Peer]; !ok || (sync.Header_Request != 0 && now-sync.Header_Request > sync_request_timeout) {
+		sync.Header_Peer = neighbours[int(random_int(0, int64(len(neighbours)-1)))]
+		if sync.Header_Request != 0 {
+			peer.__request_headers()
+		}
+	}
+
+	peer.__connect_synced_blocks() // relayed blocks may have caught up with the header chain
+	if peer.Sync == nil {
+		return
+	}
+
+	in_flight := make(map[Address]int) // {neighbour: bodies asked of it that did not arrive yet}
+	for block_hash, request := range sync.Requests {
+		if _, ok := peer.Neighbours[request.Neighbour]; !ok || now-request.Sent_At > sync_request_timeout {
+			delete(sync.Requests, block_hash)
+		} else {
+			in_flight[request.Neighbour]++
+		}
+	}
+
+	batches := make(map[Address][]Hash)
+	next := 0
+	for _, block_hash := range sync.Header_Chain[:min(len(sync.Header_Chain), sync_download_window)] {
+		if _, ok := sync.Bodies[block_hash]; ok {
+			continue
+		}
+		if _, ok := sync.Requests[block_hash]; ok {
+			continue
+		}
+		// find the next neighbour in turn that can take another request and whose chain was at least as high as the
+		// block when it connected, the header peer is known to have every block
+		assigned, height := false, sync.Headers[block_hash].Height
+		for tries := 0; tries < len(neighbours) && !assigned; tries++ {
+			neighbour := neighbours[next]
+			has_block := neighbour == sync.Header_Peer || peer.Neighbour_Handshakes[neighbour].Height >= height
+			if has_block && in_flight[neighbour] < sync_requests_per_neighbour*sync_bodies_per_request {
+				batches[neighbour] = append(batches[neighbour], block_hash)
+				sync.Requests[block_hash] = BodyRequest{Neighbour: neighbour, Sent_At: now}
+				in_flight[neighbour]++
+				assigned = true
+				if len(batches[neighbour]) == sync_bodies_per_request {
+					peer.__send(GetBlockBodiesMessage{Block_Hashes: batches[neighbour]}, neighbour)
+					batches[neighbour] = nil
+				}
+			}
+			next = (next + 1) % len(neighbours)
+		}
+		if !assigned {
+			break // every neighbour has as many requests as it may have
+		}
+	}
+	for neighbour, block_hashes := range batches {
+		if len(block_hashes) > 0 {
+			peer.__send(GetBlockBodiesMessage{Block_Hashes: block_hashes}, neighbour)
+		}
+	}
+
+	if now-sync.Last_Report >= 5 {
+		peer.__report_sync("downloading blocks")
+	}
+}
+
+// Peer's method __serve_bodies sends the merkel trees of the requested blocks the peer has back to the neighbour
+// that asked for them, leaving out those that do not fit in a single message
+func (peer *Peer) __serve_bodies(block_hashes []Hash, to Address) {
+	merkel_trees, size := make([]MerkelTree, 0, len(block_hashes)), 0
+	for _, block_hash := range block_hashes {
+		block, ok := peer.Blockchain.Blocks[block_hash]
+		if !ok {
+			continue
+		}
+		merkel_tree := peer.Blockchain.Merkel_Trees[block.Merkel_Root]
+		if size += len(merkel_tree.encode_wire()); size > max_block_bodies_size {
+			break
+		}
+		merkel_trees = append(merkel_trees, merkel_tree)
+	}
+	peer.__send(BlockBodiesMessage{Merkel_Trees: merkel_trees}, to)
+}
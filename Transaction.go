@@ -1,11 +1,181 @@
 package main
 
-// Type Transaction holds all the information about a single transaction
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Type OutPoint references a single output of a transaction
+type OutPoint struct {
+	Transaction Hash
+	Index       uint32
+}
+
+func (out_point OutPoint) less(other OutPoint) bool {
+	if out_point.Transaction != other.Transaction {
+		return bytes.Compare(out_point.Transaction.Value[:], other.Transaction.Value[:]) < 0
+	}
+	return out_point.Index < other.Index
+}
+
+func (out_point OutPoint) to_string() string {
+	return fmt.Sprintf("%s:%d", out_point.Transaction.to_string(), out_point.Index)
+}
+
+// Type TxOutput holds an amount that can later be spent by its owner
+type TxOutput struct {
+	Owner  string
+	Amount uint64
+}
+
+// Type Transaction holds all the information about a single transaction.
+//
+// In the account ledger mode a transaction moves Amount from the account From to the account To and
+// Inputs and Outputs are empty. In the utxo ledger mode a transaction spends the Inputs, which must all be owned by
+// From, and creates the Outputs. To, Amount and Nonce are then zero and the inputs must add up to the outputs plus Fee.
+//
+// In both modes From is the address of Public_Key and Signature is the signature of the canonical encoding by its key.
+// The exception is the coinbase transaction of a block, which has no sender or signature and pays the block reward
+// plus the fees of the block to the miner
 type Transaction struct {
-	Value    string
-	Not_Null bool
+	From        string
+	To          string
+	Amount      uint64
+	Fee         uint64
+	Nonce       uint64 // number of transactions sent by From before this one
+	Memo        string
+	Inputs      []OutPoint
+	Outputs     []TxOutput
+	Public_Key  []byte
+	Signature   []byte
+	Is_Coinbase bool
+	Not_Null    bool
+}
+
+// function create_transaction returns a transaction moving amount (plus fee) from one account to another
+func create_transaction(from string, to string, amount uint64, fee uint64, nonce uint64, memo string) Transaction {
+	return Transaction{From: from, To: to, Amount: amount, Fee: fee, Nonce: nonce, Memo: memo, Not_Null: true}
+}
+
+// function create_utxo_transaction returns a transaction spending the given outputs owned by from
+func create_utxo_transaction(from string, inputs []OutPoint, outputs []TxOutput, fee uint64, memo string) Transaction {
+	return Transaction{From: from, Fee: fee, Memo: memo, Inputs: inputs, Outputs: outputs, Not_Null: true}
+}
+
+// function create_coinbase returns the coinbase transaction of a block mined on top of prev_block that pays amount
+// to the miner. the previous block's hash is kept in the memo so that coinbases of different blocks differ
+func create_coinbase(ledger_mode int, miner string, amount uint64, prev_block Hash) Transaction {
+	transaction := Transaction{Memo: prev_block.to_string(), Is_Coinbase: true, Not_Null: true}
+	if ledger_mode == ledger_mode_utxo {
+		transaction.Outputs = []TxOutput{{Owner: miner, Amount: amount}}
+	} else {
+		transaction.To, transaction.Amount = miner, amount
+	}
+	return transaction
+}
+
+// Transaction's method encode returns the canonical byte encoding of the transaction which is used for hashing
+// and signing. the signature itself is not part of the encoding
+func (transaction Transaction) encode() []byte {
+	buf := make([]byte, 0, 64+len(transaction.From)+len(transaction.To)+len(transaction.Memo))
+	buf = append_string(buf, transaction.From)
+	buf = append_string(buf, transaction.To)
+	buf = append_uint64(buf, transaction.Amount)
+	buf = append_uint64(buf, transaction.Fee)
+	buf = append_uint64(buf, transaction.Nonce)
+	buf = append_string(buf, transaction.Memo)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(transaction.Inputs)))
+	for _, input := range transaction.Inputs {
+		buf = append(buf, input.Transaction.Value[:]...)
+		buf = binary.BigEndian.AppendUint32(buf, input.Index)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(transaction.Outputs)))
+	for _, output := range transaction.Outputs {
+		buf = append_string(buf, output.Owner)
+		buf = append_uint64(buf, output.Amount)
+	}
+	buf = append_string(buf, string(transaction.Public_Key))
+	if transaction.Is_Coinbase {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return buf
 }
 
 func (transaction Transaction) hashed() Hash {
-	return hash_string(transaction.Value)
+	return Hash{Value: sha256.Sum256(transaction.encode())}
+}
+
+// Transaction's method sign sets the public key of the transaction to the given key's and signs the transaction
+func (transaction *Transaction) sign(private_key ed25519.PrivateKey) {
+	transaction.Public_Key = private_key.Public().(ed25519.PublicKey)
+	transaction.Signature = ed25519.Sign(private_key, transaction.encode())
+}
+
+// Transaction's method has_valid_signature checks that the sender is the address of the transaction's public key
+// and that the signature was made by that key
+func (transaction Transaction) has_valid_signature() bool {
+	if len(transaction.Public_Key) != ed25519.PublicKeySize || len(transaction.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	if transaction.From != address_from_public_key(transaction.Public_Key) {
+		return false
+	}
+	return ed25519.Verify(transaction.Public_Key, transaction.encode(), transaction.Signature)
+}
+
+// Transaction's method less orders the coinbase first and the rest by sender, then nonce, then hash. this is the
+// order in which the transactions of a merkel tree are placed in its leaves and applied to the ledger
+func (transaction Transaction) less(other Transaction) bool {
+	return transaction.less_hashed(transaction.hashed(), other, other.hashed())
+}
+
+// Transaction's method less_hashed orders transactions like less, taking the hashes of both transactions instead of
+// computing them so that sorting many transactions hashes each one only once
+func (transaction Transaction) less_hashed(transaction_hash Hash, other Transaction, other_hash Hash) bool {
+	if transaction.Is_Coinbase != other.Is_Coinbase {
+		return transaction.Is_Coinbase
+	}
+	if transaction.From != other.From {
+		return transaction.From < other.From
+	}
+	if transaction.Nonce != other.Nonce {
+		return transaction.Nonce < other.Nonce
+	}
+	return bytes.Compare(transaction_hash.Value[:], other_hash.Value[:]) < 0
+}
+
+// Transaction's method is_utxo returns true if the transaction spends and creates outputs instead of moving a balance
+func (transaction Transaction) is_utxo() bool {
+	return len(transaction.Inputs) > 0 || len(transaction.Outputs) > 0
+}
+
+func (transaction Transaction) to_string() string {
+	if transaction.Is_Coinbase {
+		to, amount := transaction.To, transaction.Amount
+		if len(transaction.Outputs) > 0 {
+			to, amount = transaction.Outputs[0].Owner, transaction.Outputs[0].Amount
+		}
+		return fmt.Sprintf("coinbase -> %s amount %d", to, amount)
+	}
+	if transaction.is_utxo() {
+		out := fmt.Sprintf("%s spends %d outputs ->", transaction.From, len(transaction.Inputs))
+		for _, output := range transaction.Outputs {
+			out += fmt.Sprintf(" %s:%d", output.Owner, output.Amount)
+		}
+		out += fmt.Sprintf(" fee %d", transaction.Fee)
+		if transaction.Memo != "" {
+			out += fmt.Sprintf(" memo %q", transaction.Memo)
+		}
+		return out
+	}
+	out := fmt.Sprintf("%s -> %s amount %d fee %d nonce %d", transaction.From, transaction.To, transaction.Amount, transaction.Fee, transaction.Nonce)
+	if transaction.Memo != "" {
+		out += fmt.Sprintf(" memo %q", transaction.Memo)
+	}
+	return out
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// magic bytes at the start of every wallet file, followed by the salt, the nonce and the encrypted keys
+var wallet_file_magic = []byte("BCWALLET1")
+
+// number of sha256 rounds used to turn a passphrase into an encryption key
+const wallet_key_rounds = 200000
+
+// Type WalletKey holds a single key of a wallet
+type WalletKey struct {
+	Label   string
+	Seed    string // hex encoded ed25519 seed
+	Address string
+}
+
+// Type Wallet holds the keys of a user. it is stored encrypted with a passphrase
+type Wallet struct {
+	Keys []WalletKey
+}
+
+// Wallet's method new_key generates a new key, adds it to the wallet and returns its address
+func (wallet *Wallet) new_key(label string) string {
+	private_key := generate_key()
+	wallet.Keys = append(wallet.Keys, WalletKey{Label: label, Seed: key_seed(private_key), Address: address_from_key(private_key)})
+	return address_from_key(private_key)
+}
+
+// Wallet's method import_key adds the key with the given hex encoded seed to the wallet and returns its address
+func (wallet *Wallet) import_key(seed string, label string) (string, error) {
+	private_key, err := key_from_seed(seed)
+	if err != nil {
+		return "", err
+	}
+	address := address_from_key(private_key)
+	if _, ok := wallet.find_key(address); ok {
+		return "", fmt.Errorf("key of %s is already in the wallet", address)
+	}
+	wallet.Keys = append(wallet.Keys, WalletKey{Label: label, Seed: key_seed(private_key), Address: address})
+	return address, nil
+}
+
+// Wallet's method export_key returns the hex encoded seed of the key owning the given address
+func (wallet Wallet) export_key(address string) (string, error) {
+	private_key, ok := wallet.find_key(address)
+	if !ok {
+		return "", fmt.Errorf("no key for %s in the wallet", address)
+	}
+	return key_seed(private_key), nil
+}
+
+// Wallet's method find_key returns the private key owning the given address. an empty address selects the first key
+func (wallet Wallet) find_key(address string) (ed25519.PrivateKey, bool) {
+	for _, key := range wallet.Keys {
+		if address == "" || key.Address == address {
+			private_key, err := key_from_seed(key.Seed)
+			return private_key, err == nil
+		}
+	}
+	return nil, false
+}
+
+// Wallet's method save encrypts the wallet using the passphrase and writes it to the given file
+func (wallet Wallet) save(filename string, passphrase string) error {
+	plain, err := json.Marshal(wallet)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := __wallet_cipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append([]byte{}, wallet_file_magic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, plain, wallet_file_magic)
+	return os.WriteFile(filename, out, 0600)
+}
+
+// function load_wallet reads and decrypts a wallet that was written using save
+func load_wallet(filename string, passphrase string) (Wallet, error) {
+	wallet := Wallet{}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return wallet, err
+	}
+	if !bytes.HasPrefix(raw, wallet_file_magic) {
+		return wallet, errors.New("not a wallet file")
+	}
+	raw = raw[len(wallet_file_magic):]
+	if len(raw) < 16 {
+		return wallet, errors.New("wallet file is truncated")
+	}
+	aead, err := __wallet_cipher(passphrase, raw[:16])
+	if err != nil {
+		return wallet, err
+	}
+	raw = raw[16:]
+	if len(raw) < aead.NonceSize() {
+		return wallet, errors.New("wallet file is truncated")
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], wallet_file_magic)
+	if err != nil {
+		return wallet, errors.New("wrong passphrase or corrupted wallet file")
+	}
+	err = json.Unmarshal(plain, &wallet)
+	return wallet, err
+}
+
+// function __wallet_cipher derives an aes-256-gcm cipher from the passphrase and salt. the passphrase is stretched
+// with repeated salted sha256 rounds to slow down guessing, since the standard library has no password hashing
+func __wallet_cipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append(append([]byte{}, salt...), passphrase...))
+	for i := 0; i < wallet_key_rounds; i++ {
+		key = sha256.Sum256(append(key[:], salt...))
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// function create_payment builds and signs a transaction paying amount to the given address from the key's address.
+// in the account ledger mode a nonce of -1 uses the next nonce of the sender in the ledger. in the utxo ledger mode
+// the sender's unspent outputs are spent and the remainder is paid back as change
+func create_payment(ledger Ledger, private_key ed25519.PrivateKey, to string, amount uint64, fee uint64, nonce int64, memo string) (Transaction, error) {
+	from := address_from_key(private_key)
+	if !is_valid_address(to) {
+		return Transaction{}, fmt.Errorf("%q is not a valid address", to)
+	}
+	if amount == 0 {
+		return Transaction{}, errors.New("amount should be positive")
+	}
+
+	var transaction Transaction
+	if ledger.Mode == ledger_mode_utxo {
+		inputs, total_in := make([]OutPoint, 0), uint64(0)
+		for _, out_point := range ledger.get_utxos(from) {
+			if total_in >= amount+fee {
+				break
+			}
+			inputs = append(inputs, out_point)
+			total_in += ledger.Utxos[out_point].Output.Amount
+		}
+		if total_in < amount+fee {
+			return Transaction{}, fmt.Errorf("balance of %d is not enough to pay %d", total_in, amount+fee)
+		}
+		outputs := []TxOutput{{Owner: to, Amount: amount}}
+		if change := total_in - amount - fee; change > 0 {
+			outputs = append(outputs, TxOutput{Owner: from, Amount: change})
+		}
+		transaction = create_utxo_transaction(from, inputs, outputs, fee, memo)
+	} else {
+		account := ledger.get_account(from)
+		if account.Balance < amount+fee {
+			return Transaction{}, fmt.Errorf("balance of %d is not enough to pay %d", account.Balance, amount+fee)
+		}
+		if nonce < 0 {
+			nonce = int64(account.Nonce)
+		}
+		transaction = create_transaction(from, to, amount, fee, uint64(nonce), memo)
+	}
+	transaction.sign(private_key)
+	return transaction, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// error returned when an encoding ends before all of its fields are read
+var err_short_wire_data = errors.New("wire data ends early")
+
+// size of a block header in its canonical encoding
+const block_header_size = 4 + 8 + 8 + 32 + 32 + 4 + 32
+
+// Type WireReader reads the fields of a canonical encoding in order. once a read fails every later read returns zero
+// values and the first error is kept in Err
+type WireReader struct {
+	Data []byte // bytes not read yet
+	Err  error
+}
+
+func (reader *WireReader) read_bytes(count int) []byte {
+	if reader.Err != nil {
+		return nil
+	}
+	if count < 0 || count > len(reader.Data) {
+		reader.Err = err_short_wire_data
+		return nil
+	}
+	out := reader.Data[:count]
+	reader.Data = reader.Data[count:]
+	return out
+}
+
+func (reader *WireReader) read_uint8() uint8 {
+	if raw := reader.read_bytes(1); raw != nil {
+		return raw[0]
+	}
+	return 0
+}
+
+func (reader *WireReader) read_uint16() uint16 {
+	if raw := reader.read_bytes(2); raw != nil {
+		return binary.BigEndian.Uint16(raw)
+	}
+	return 0
+}
+
+func (reader *WireReader) read_uint32() uint32 {
+	if raw := reader.read_bytes(4); raw != nil {
+		return binary.BigEndian.Uint32(raw)
+	}
+	return 0
+}
+
+func (reader *WireReader) read_uint64() uint64 {
+	if raw := reader.read_bytes(8); raw != nil {
+		return binary.BigEndian.Uint64(raw)
+	}
+	return 0
+}
+
+func (reader *WireReader) read_bool() bool {
+	value := reader.read_uint8()
+	if value > 1 {
+		reader.Err = fmt.Errorf("%d is not a boolean", value)
+	}
+	return value == 1
+}
+
+func (reader *WireReader) read_hash() Hash {
+	hash := Hash{}
+	copy(hash.Value[:], reader.read_bytes(len(hash.Value)))
+	return hash
+}
+
+// WireReader's method read_var_bytes reads bytes written with a 4 byte length prefix, as written by append_string
+func (reader *WireReader) read_var_bytes() []byte {
+	return reader.read_bytes(int(reader.read_uint32()))
+}
+
+func (reader *WireReader) read_string() string {
+	return string(reader.read_var_bytes())
+}
+
+// WireReader's method read_count reads the 4 byte length of a list whose items take at least item_size bytes each. a
+// length the remaining data can not hold fails the read, so that a corrupt length never allocates a huge list
+func (reader *WireReader) read_count(item_size int) int {
+	count := reader.read_uint32()
+	if reader.Err == nil && uint64(count)*uint64(item_size) > uint64(len(reader.Data)) {
+		reader.Err = err_short_wire_data
+		return 0
+	}
+	return int(count)
+}
+
+// WireReader's method finish returns the first error of the reads, or an error if bytes were left unread
+func (reader *WireReader) finish() error {
+	if reader.Err == nil && len(reader.Data) > 0 {
+		return fmt.Errorf("%d unexpected bytes after the wire data", len(reader.Data))
+	}
+	return reader.Err
+}
+
+func append_bool(buf []byte, value bool) []byte {
+	if value {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+// function append_hashes appends the number of hashes followed by the hashes to buf
+func append_hashes(buf []byte, hashes []Hash) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(hashes)))
+	for _, hash := range hashes {
+		buf = append(buf, hash.Value[:]...)
+	}
+	return buf
+}
+
+// WireReader's method read_hashes reads a list of hashes written by append_hashes
+func (reader *WireReader) read_hashes() []Hash {
+	hashes := make([]Hash, reader.read_count(32))
+	for i := range hashes {
+		hashes[i] = reader.read_hash()
+	}
+	return hashes
+}
+
+// function append_inventory appends the number of items followed by each item as its type in a single byte and its
+// hash
+func append_inventory(buf []byte, items []InvItem) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(items)))
+	for _, item := range items {
+		buf = append(append(buf, uint8(item.Type)), item.Hash.Value[:]...)
+	}
+	return buf
+}
+
+// WireReader's method read_inventory reads a list of items written by append_inventory, an unknown item type fails the
+// read
+func (reader *WireReader) read_inventory() []InvItem {
+	items := make([]InvItem, reader.read_count(1+32))
+	for i := range items {
+		items[i] = InvItem{Type: int(reader.read_uint8()), Hash: reader.read_hash()}
+		if items[i].Type > inv_type_compact_block && reader.Err == nil {
+			reader.Err = fmt.Errorf("unknown inventory type %d", items[i].Type)
+		}
+	}
+	return items
+}
+
+func append_address(buf []byte, address Address) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, address.Ip)
+	return binary.BigEndian.AppendUint16(buf, address.Port)
+}
+
+func (reader *WireReader) read_address() Address {
+	return Address{Ip: reader.read_uint32(), Port: reader.read_uint16()}
+}
+
+// WireReader's method read_block_header reads a block header written by Block's method encode_header
+func (reader *WireReader) read_block_header() Block {
+	block := Block{}
+	block.Version = reader.read_uint32()
+	block.Height = reader.read_uint64()
+	block.Timestamp = int64(reader.read_uint64())
+	block.Prev_Block = reader.read_hash()
+	block.Merkel_Root = reader.read_hash()
+	block.Trailing_Zeros = int(int32(reader.read_uint32()))
+	block.Nonce = reader.read_hash()
+	return block
+}
+
+// Transaction's method encode_wire returns the encoding the transaction is sent in: its canonical encoding followed
+// by the signature
+func (transaction Transaction) encode_wire() []byte {
+	return append_string(transaction.encode(), string(transaction.Signature))
+}
+
+// WireReader's method read_transaction reads a transaction written by Transaction's method encode_wire
+func (reader *WireReader) read_transaction() Transaction {
+	remaining := len(reader.Data)
+	defer func() {
+		if remaining-len(reader.Data) > max_transaction_size && reader.Err == nil {
+			reader.Err = fmt.Errorf("transaction of %d bytes is too long", remaining-len(reader.Data))
+		}
+	}()
+	transaction := Transaction{Not_Null: true}
+	transaction.From = reader.read_string()
+	transaction.To = reader.read_string()
+	transaction.Amount = reader.read_uint64()
+	transaction.Fee = reader.read_uint64()
+	transaction.Nonce = reader.read_uint64()
+	transaction.Memo = reader.read_string()
+	if count := reader.read_count(32 + 4); count > 0 {
+		transaction.Inputs = make([]OutPoint, count)
+		for i := range transaction.Inputs {
+			transaction.Inputs[i] = OutPoint{Transaction: reader.read_hash(), Index: reader.read_uint32()}
+		}
+	}
+	if count := reader.read_count(4 + 8); count > 0 {
+		transaction.Outputs = make([]TxOutput, count)
+		for i := range transaction.Outputs {
+			transaction.Outputs[i] = TxOutput{Owner: reader.read_string(), Amount: reader.read_uint64()}
+		}
+	}
+	if public_key := reader.read_var_bytes(); len(public_key) > 0 {
+		transaction.Public_Key = append([]byte{}, public_key...)
+	}
+	transaction.Is_Coinbase = reader.read_bool()
+	if signature := reader.read_var_bytes(); len(signature) > 0 {
+		transaction.Signature = append([]byte{}, signature...)
+	}
+	return transaction
+}
+
+// MerkelTree's method encode_wire returns the encoding the merkel tree is sent in: the number of transactions
+// followed by the transactions in the order of the leaves. the nodes are not sent, the receiver builds them again
+func (merkel_tree MerkelTree) encode_wire() []byte {
+	transactions := merkel_tree.ordered_transactions()
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(transactions)))
+	for _, transaction := range transactions {
+		buf = append(buf, transaction.encode_wire()...)
+	}
+	return buf
+}
+
+// WireReader's method read_merkel_tree reads a merkel tree written by MerkelTree's method encode_wire. the tree is not
+// built, the receiver builds it once it knows the sender is a neighbour
+func (reader *WireReader) read_merkel_tree() MerkelTree {
+	merkel_tree := create_merkel_tree()
+	count := reader.read_count(1)
+	if count == 0 && reader.Err == nil {
+		reader.Err = errors.New("merkel tree holds no transactions")
+	}
+	for i := 0; i < count && reader.Err == nil; i++ {
+		if !merkel_tree.add_transaction(reader.read_transaction()) && reader.Err == nil {
+			reader.Err = errors.New("merkel tree holds a transaction twice")
+		}
+	}
+	return merkel_tree
+}
+
+// Handshake's method encode_wire returns the canonical encoding of the handshake
+func (handshake Handshake) encode_wire() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, handshake.Protocol_Version)
+	buf = append_string(buf, handshake.Software_Version)
+	buf = append_uint64(buf, handshake.Features)
+	buf = append_uint64(buf, handshake.Height)
+	buf = append(buf, handshake.Tip.Value[:]...)
+	return append(buf, handshake.Node_Id.Value[:]...)
+}
+
+func (reader *WireReader) read_handshake() Handshake {
+	handshake := Handshake{Protocol_Version: reader.read_uint32(), Software_Version: reader.read_string()}
+	if len(handshake.Software_Version) > max_software_version_size && reader.Err == nil {
+		reader.Err = fmt.Errorf("software version of %d bytes is too long", len(handshake.Software_Version))
+	}
+	handshake.Features = reader.read_uint64()
+	handshake.Height = reader.read_uint64()
+	handshake.Tip = reader.read_hash()
+	handshake.Node_Id = reader.read_hash()
+	return handshake
+}
+
+// size of the encoding of mempool stats
+const mempool_stats_size = 8 * 8
+
+// MempoolStats's method encode_wire returns the count and bytes, the fee rates as ieee 754 doubles and the counters of
+// added, evicted, expired and rejected transactions, each as 8 bytes
+func (stats MempoolStats) encode_wire() []byte {
+	buf := append_uint64(nil, uint64(stats.Count))
+	buf = append_uint64(buf, uint64(stats.Bytes))
+	buf = append_uint64(buf, math.Float64bits(stats.Min_Fee_Rate))
+	buf = append_uint64(buf, math.Float64bits(stats.Max_Fee_Rate))
+	buf = append_uint64(buf, stats.Added)
+	buf = append_uint64(buf, stats.Evicted)
+	buf = append_uint64(buf, stats.Expired)
+	return append_uint64(buf, stats.Rejected)
+}
+
+func (reader *WireReader) read_mempool_stats() MempoolStats {
+	stats := MempoolStats{Count: int(reader.read_uint64()), Bytes: int(reader.read_uint64())}
+	stats.Min_Fee_Rate = math.Float64frombits(reader.read_uint64())
+	stats.Max_Fee_Rate = math.Float64frombits(reader.read_uint64())
+	stats.Added = reader.read_uint64()
+	stats.Evicted = reader.read_uint64()
+	stats.Expired = reader.read_uint64()
+	stats.Rejected = reader.read_uint64()
+	return stats
+}
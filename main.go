@@ -1,13 +1,7 @@
 package main
 
+import "os"
+
 func main() {
-	scenario_number := 0
-	switch scenario_number {
-	case 0:
-		scenario_connection_control()
-	case 1:
-		scenario_blockchain_observation()
-	case 2:
-		scenario_blockchain_bad_node()
-	}
+	os.Exit(run_cli(os.Args[1:]))
 }
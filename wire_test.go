@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// golden vectors of docs/wire-format.md, each a whole packet without its frame length
+var golden_vectors = []struct {
+	name string
+	hex  string
+}{
+	{"hello", "4243474fdc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c500000002087f0000011f91"},
+	{"need block", "4243474fdc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c500000002057f0000011f91496aca80e4d8f29fb8e8cd816c3afb48d3f103970b3a2ee1600c08ca67326dee"},
+	{"ip port list", "4243474fdc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c500000002077f0000011f91000000027f0000011f92000000001f93"},
+	{"new connection", "4243474fdc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c500000002007f0000011f910000000200000017626c6f636b636861696e2d676f6c616e672f302e312e3000000000000000000000000000000001dc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c5545ea538461003efdc8c81c244531b003f6f26cfccf6c0073b3239fdedf49446"},
+	{"new transaction", "4243474fdc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c500000002037f0000011f9100000022314e3978663564787848326f66694d78647559614c5037526272336e4c673776566f0000002231385a644771787a423233364638646b67326f48753839665a6a5478356565524453000000000000000a000000000000000100000000000000000000000268690000000000000000000000200d6d8b0a42e2dbbd7602ec477766e12756301b39c2748c281c463dcb8cff3a5800000000400ce3f1f049545441730aaa64e831d3dfb939c93d0eef7441deb93425daa5808e58b76388b83070b7ba1fcf68ce29021de586af920fb52bd700c093f2b689ca07"},
+	{"new block", "4243474fdc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c500000002047f0000011f9100000001000000000000000100000000659200800000000000000000000000000000000000000000000000000000000000000000e2311ebdaac4bc43555822ccfe589232bde5fab712144f88ef3e64cdbc793ee4000000140000000000000000000000000000000000000000000000000000000000000000000000010000000000000000000000000000000000000000000000000000000000000000000000056c6f63616c0000000000000000000000000100000000"},
+}
+
+// function golden_vector_packets builds the packets the golden vectors describe, in the order of golden_vectors
+func golden_vector_packets(t testing.TB) []NetworkPacket {
+	params := ChainParams{Network_Id: "local", Genesis_Timestamp: default_genesis_timestamp, Initial_Trailing_Zeros: 20}
+	chain_id := params.chain_id()
+	if chain_id.to_string() != "dc9bcb5fad7fd590a52d206d46fff93431d6116dce65fc042ea60e64aa7251c5" {
+		t.Fatalf("chain id %s does not match the documented one", chain_id.to_string())
+	}
+
+	sender_key, err := key_from_seed(hash_string("golden vector key").to_string())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient_key, err := key_from_seed(hash_string("golden vector recipient").to_string())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction := create_transaction(address_from_key(sender_key), address_from_key(recipient_key), 10, 1, 0, "hi")
+	transaction.sign(sender_key)
+	if transaction.hashed().to_string() != "a60d69a7242c7acc473f1e1bbb3afddbf0bcc0bc61d0ac98bee0ab145f3e9528" {
+		t.Fatalf("transaction hash %s does not match the documented one", transaction.hashed().to_string())
+	}
+	genesis, merkel_tree := genesis_block(params)
+
+	messages := []Message{
+		HelloMessage{},
+		NeedBlockMessage{Block_Hash: hash_string("block")},
+		IpPortListMessage{Ip_Port_List: []Address{{Ip: 0x7f000001, Port: 8082}, {Port: 8083}}},
+		NewConnectionMessage{Handshake: Handshake{Protocol_Version: protocol_version, Software_Version: "blockchain-golang/0.1.0", Height: 1, Tip: chain_id, Node_Id: hash_string("node")}},
+		NewTransactionMessage{Transaction: transaction},
+		NewBlockMessage{Block: genesis, Merkel_Tree: merkel_tree},
+	}
+	packets := make([]NetworkPacket, len(messages))
+	for i, message := range messages {
+		packets[i] = NetworkPacket{Header: create_packet_header(chain_id), Req_From: Address{Ip: 0x7f000001, Port: 8081}, Message: message}
+	}
+	return packets
+}
+
+// function __equal_packets returns true if the packets are equal. merkel trees are compared by their hash and
+// encoding, since a decoded tree need not be built yet and an empty list decodes as nil
+func __equal_packets(a NetworkPacket, b NetworkPacket) bool {
+	block_a, ok_a := a.Message.(NewBlockMessage)
+	block_b, ok_b := b.Message.(NewBlockMessage)
+	if !ok_a || !ok_b {
+		return reflect.DeepEqual(a, b)
+	}
+	a.Message, b.Message = nil, nil
+	return reflect.DeepEqual(a, b) && block_a.Block == block_b.Block && block_a.Merkel_Tree.hashed() == block_b.Merkel_Tree.hashed() &&
+		bytes.Equal(block_a.Merkel_Tree.encode_wire(), block_b.Merkel_Tree.encode_wire())
+}
+
+func TestGoldenVectors(t *testing.T) {
+	packets := golden_vector_packets(t)
+	for i, vector := range golden_vectors {
+		raw, err := hex.DecodeString(vector.hex)
+		if err != nil {
+			t.Fatalf("%s: %v", vector.name, err)
+		}
+		if encoded := encode_packet(packets[i]); !bytes.Equal(encoded, raw) {
+			t.Errorf("%s: encoded as\n%x\nwant\n%x", vector.name, encoded, raw)
+		}
+		decoded, err := decode_packet(raw)
+		if err != nil {
+			t.Errorf("%s: %v", vector.name, err)
+			continue
+		}
+		if !__equal_packets(decoded, packets[i]) {
+			t.Errorf("%s: decoded as %+v, want %+v", vector.name, decoded, packets[i])
+		}
+	}
+}
+
+// function __check_reencoding fails the test if a decoded packet does not encode to bytes that decode again to a
+// packet of the same encoding
+func __check_reencoding(t *testing.T, network_packet NetworkPacket) {
+	encoded := encode_packet(network_packet)
+	decoded, err := decode_packet(encoded)
+	if err != nil {
+		t.Fatalf("re-encoded packet %x does not decode: %v", encoded, err)
+	}
+	if reencoded := encode_packet(decoded); !bytes.Equal(reencoded, encoded) {
+		t.Fatalf("packet re-encoded as %x, then as %x", encoded, reencoded)
+	}
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	for _, vector := range golden_vectors {
+		raw, err := hex.DecodeString(vector.hex)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(raw)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if network_packet, err := decode_packet(data); err == nil {
+			__check_reencoding(t, network_packet)
+		}
+		frame := append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
+		if network_packet, err := read_frame(bytes.NewReader(frame), 0); err == nil {
+			__check_reencoding(t, network_packet)
+		}
+	})
+}